@@ -0,0 +1,512 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// The admin API is served on its own address and only to the users listed in
+// -admin-users. Callers authenticate with a Kubernetes bearer token, checked
+// with a TokenReview, or with a client certificate signed by -admin-client-ca.
+var (
+	adminAddr     = ""
+	adminUsers    = ""
+	adminTLSCert  = ""
+	adminTLSKey   = ""
+	adminClientCA = ""
+)
+
+// tokenReviewCacheTTL is how long the result of a TokenReview is reused
+const tokenReviewCacheTTL = time.Minute
+
+// Requests waiting for, or being processed by, the processor
+var workQueue = &processingQueue{entries: make(map[int]queueEntry)}
+
+// Namespaces whose CustomSecrets aren't reconciled until resumed
+var pausedNamespaces = &namespacePauses{paused: make(map[string]time.Time)}
+
+type queueEntry struct {
+	CustomSecret string    `json:"customSecret"`
+	Namespace    string    `json:"namespace"`
+	Secret       string    `json:"secret"`
+	Source       string    `json:"source"`
+	Queued       time.Time `json:"queued"`
+}
+
+type processingQueue struct {
+	sync.Mutex
+	next    int
+	entries map[int]queueEntry
+}
+
+// add records that c is waiting to be processed and returns the id to pass
+// to done
+func (q *processingQueue) add(c CustomSecret, source string) int {
+	queueDepthGauge.add(1)
+
+	q.Lock()
+	defer q.Unlock()
+	q.next++
+	q.entries[q.next] = queueEntry{
+		CustomSecret: c.Metadata["name"],
+		Namespace:    customSecretNamespace(c),
+		Secret:       c.Spec.Secret,
+		Source:       source,
+		Queued:       time.Now().UTC(),
+	}
+	return q.next
+}
+
+func (q *processingQueue) done(id int) {
+	queueDepthGauge.add(-1)
+
+	q.Lock()
+	defer q.Unlock()
+	delete(q.entries, id)
+}
+
+// list returns the queue, oldest first
+func (q *processingQueue) list() []queueEntry {
+	q.Lock()
+	defer q.Unlock()
+
+	ids := make([]int, 0, len(q.entries))
+	for id := range q.entries {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	entries := make([]queueEntry, 0, len(ids))
+	for _, id := range ids {
+		entries = append(entries, q.entries[id])
+	}
+	return entries
+}
+
+type namespacePauses struct {
+	sync.RWMutex
+	paused map[string]time.Time
+}
+
+func (p *namespacePauses) pause(ns string) {
+	p.Lock()
+	defer p.Unlock()
+	if _, ok := p.paused[ns]; !ok {
+		p.paused[ns] = time.Now().UTC()
+	}
+}
+
+func (p *namespacePauses) resume(ns string) {
+	p.Lock()
+	defer p.Unlock()
+	delete(p.paused, ns)
+}
+
+func (p *namespacePauses) isPaused(ns string) bool {
+	p.RLock()
+	defer p.RUnlock()
+	_, ok := p.paused[ns]
+	return ok
+}
+
+func (p *namespacePauses) list() map[string]time.Time {
+	p.RLock()
+	defer p.RUnlock()
+	paused := make(map[string]time.Time, len(p.paused))
+	for ns, since := range p.paused {
+		paused[ns] = since
+	}
+	return paused
+}
+
+// customSecretNamespace returns the namespace of c
+func customSecretNamespace(c CustomSecret) string {
+	if ns := c.Metadata["namespace"]; ns != "" {
+		return ns
+	}
+	return namespace
+}
+
+type adminAuthenticator struct {
+	sync.Mutex
+	users   map[string]bool
+	reviews map[string]cachedTokenReview
+}
+
+type cachedTokenReview struct {
+	username string
+	expires  time.Time
+}
+
+func newAdminAuthenticator(users string) (*adminAuthenticator, error) {
+	a := &adminAuthenticator{
+		users:   make(map[string]bool),
+		reviews: make(map[string]cachedTokenReview),
+	}
+	for _, user := range strings.Split(users, ",") {
+		user = strings.TrimSpace(user)
+		if user != "" {
+			a.users[user] = true
+		}
+	}
+	if len(a.users) == 0 {
+		return nil, errors.New("admin-users must list at least one user")
+	}
+	return a, nil
+}
+
+// authenticate returns the user making the request. Client certificates are
+// identified by their common name.
+func (a *adminAuthenticator) authenticate(r *http.Request) (string, error) {
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		return r.TLS.VerifiedChains[0][0].Subject.CommonName, nil
+	}
+
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return "", errors.New("no client certificate or bearer token")
+	}
+	token := strings.TrimPrefix(auth, "Bearer ")
+
+	// Cache by hash so that tokens aren't kept in memory
+	sum := sha256.Sum256([]byte(token))
+	key := hex.EncodeToString(sum[:])
+
+	a.Lock()
+	cached, ok := a.reviews[key]
+	a.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.username, nil
+	}
+
+	username, err := reviewKubernetesToken(token)
+	if err != nil {
+		return "", err
+	}
+
+	a.Lock()
+	for k, review := range a.reviews {
+		if time.Now().After(review.expires) {
+			delete(a.reviews, k)
+		}
+	}
+	a.reviews[key] = cachedTokenReview{username: username, expires: time.Now().Add(tokenReviewCacheTTL)}
+	a.Unlock()
+
+	return username, nil
+}
+
+// wrap only lets authorized users through to h
+func (a *adminAuthenticator) wrap(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username, err := a.authenticate(r)
+		if err != nil {
+			logWarn("Admin request not authenticated", logFields{"path": r.URL.Path, "error": err})
+			writeAdminError(w, http.StatusUnauthorized, errors.New("not authenticated"))
+			return
+		}
+		if !a.users[username] {
+			logWarn("Admin request not authorized", logFields{"user": username, "path": r.URL.Path})
+			writeAdminError(w, http.StatusForbidden, fmt.Errorf("%s is not an admin user", username))
+			return
+		}
+
+		logInfo("Admin request", logFields{"user": username, "method": r.Method, "path": r.URL.Path})
+		h(w, r)
+	}
+}
+
+// newAdminServer returns the server for the admin API on adminAddr
+func newAdminServer(db *bolt.DB) (*http.Server, error) {
+	auth, err := newAdminAuthenticator(adminUsers)
+	if err != nil {
+		return nil, err
+	}
+
+	api := &adminAPI{db: db}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/secrets", auth.wrap(api.secrets))
+	mux.HandleFunc("/v1/secrets/", auth.wrap(api.secret))
+	mux.HandleFunc("/v1/rotate", auth.wrap(api.all(rotateCustomSecret)))
+	mux.HandleFunc("/v1/resync", auth.wrap(api.all(resyncCustomSecret)))
+	mux.HandleFunc("/v1/namespaces", auth.wrap(api.namespaces))
+	mux.HandleFunc("/v1/namespaces/", auth.wrap(api.namespace))
+	mux.HandleFunc("/v1/queue", auth.wrap(api.queue))
+	mux.HandleFunc("/v1/state", auth.wrap(api.state))
+
+	server := &http.Server{Addr: adminAddr, Handler: mux}
+
+	if adminTLSCert == "" {
+		if adminClientCA != "" {
+			return nil, errors.New("admin-client-ca requires admin-tls-cert and admin-tls-key")
+		}
+		return server, nil
+	}
+
+	server.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	if adminClientCA != "" {
+		pem, err := ioutil.ReadFile(adminClientCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", adminClientCA)
+		}
+		server.TLSConfig.ClientCAs = pool
+		server.TLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return server, nil
+}
+
+// serveAdminAPI serves the admin API until it fails
+func serveAdminAPI(server *http.Server) error {
+	if server.TLSConfig == nil {
+		logWarn("Admin API is served without TLS, bearer tokens are sent in the clear", logFields{"addr": server.Addr})
+		return server.ListenAndServe()
+	}
+	return server.ListenAndServeTLS(adminTLSCert, adminTLSKey)
+}
+
+type adminAPI struct {
+	db *bolt.DB
+}
+
+// GET /v1/secrets
+func (a *adminAPI) secrets(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, "GET") {
+		return
+	}
+
+	secrets, err := listSecretsLocal(a.db)
+	if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err)
+		return
+	}
+	customSecrets, err := getCustomSecrets()
+	if err != nil {
+		writeAdminError(w, http.StatusBadGateway, err)
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, secretStatuses(secrets, customSecrets))
+}
+
+// GET /v1/secrets/NAME and POST /v1/secrets/NAME/{rotate,renew,revoke,resync}
+func (a *adminAPI) secret(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v1/secrets/"), "/")
+	if parts[0] == "" || len(parts) > 2 {
+		writeAdminError(w, http.StatusNotFound, errors.New("not found"))
+		return
+	}
+
+	c, err := findCustomSecret(parts[0])
+	if err != nil {
+		writeAdminError(w, http.StatusNotFound, err)
+		return
+	}
+
+	if len(parts) == 1 {
+		if !allowMethod(w, r, "GET") {
+			return
+		}
+		spec, err := getSecretLocal(c.Spec.Secret, a.db)
+		if err != nil {
+			writeAdminError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if spec == nil {
+			writeAdminError(w, http.StatusNotFound, fmt.Errorf("no state stored for secret %q", c.Spec.Secret))
+			return
+		}
+		writeAdminJSON(w, http.StatusOK, storedSecretSpec(*spec))
+		return
+	}
+
+	var op func(CustomSecret, *bolt.DB) error
+	switch parts[1] {
+	case "rotate":
+		op = rotateCustomSecret
+	case "renew":
+		op = renewCustomSecret
+	case "revoke":
+		op = revokeCustomSecret
+	case "resync":
+		op = resyncCustomSecret
+	default:
+		writeAdminError(w, http.StatusNotFound, errors.New("not found"))
+		return
+	}
+	if !allowMethod(w, r, "POST") {
+		return
+	}
+
+	err = op(*c, a.db)
+	if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, map[string]string{c.Spec.Secret: "done"})
+}
+
+// all applies op to every CustomSecret, for POST /v1/rotate and /v1/resync
+func (a *adminAPI) all(op func(CustomSecret, *bolt.DB) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethod(w, r, "POST") {
+			return
+		}
+
+		customSecrets, err := getCustomSecrets()
+		if err != nil {
+			writeAdminError(w, http.StatusBadGateway, err)
+			return
+		}
+
+		status := http.StatusOK
+		results := make(map[string]string)
+		for _, c := range customSecrets {
+			if pausedNamespaces.isPaused(customSecretNamespace(c)) {
+				results[c.Spec.Secret] = "paused"
+				continue
+			}
+			err := op(c, a.db)
+			if err != nil {
+				status = http.StatusInternalServerError
+				results[c.Spec.Secret] = redactor.redact(err.Error())
+				continue
+			}
+			results[c.Spec.Secret] = "done"
+		}
+		writeAdminJSON(w, status, results)
+	}
+}
+
+// GET /v1/namespaces lists paused namespaces
+func (a *adminAPI) namespaces(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, "GET") {
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, pausedNamespaces.list())
+}
+
+// POST /v1/namespaces/NAMESPACE/{pause,resume}
+func (a *adminAPI) namespace(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v1/namespaces/"), "/")
+	if len(parts) != 2 || parts[0] == "" {
+		writeAdminError(w, http.StatusNotFound, errors.New("not found"))
+		return
+	}
+	if !allowMethod(w, r, "POST") {
+		return
+	}
+
+	switch parts[1] {
+	case "pause":
+		pausedNamespaces.pause(parts[0])
+		logInfo("Reconciliation paused", logFields{"namespace": parts[0]})
+	case "resume":
+		pausedNamespaces.resume(parts[0])
+		logInfo("Reconciliation resumed", logFields{"namespace": parts[0]})
+	default:
+		writeAdminError(w, http.StatusNotFound, errors.New("not found"))
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, pausedNamespaces.list())
+}
+
+// GET /v1/queue
+func (a *adminAPI) queue(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, "GET") {
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, workQueue.list())
+}
+
+// GET /v1/state exports the state store, PUT /v1/state imports it
+func (a *adminAPI) state(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		secrets, err := listSecretsLocal(a.db)
+		if err != nil {
+			writeAdminError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeAdminJSON(w, http.StatusOK, newStateExport(secrets))
+	case "PUT":
+		var state stateExport
+		err := json.NewDecoder(r.Body).Decode(&state)
+		if err != nil {
+			writeAdminError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		processorLock.Lock()
+		err = importState(state, a.db)
+		processorLock.Unlock()
+		if err != nil {
+			writeAdminError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeAdminJSON(w, http.StatusOK, map[string]int{"imported": len(state.Secrets)})
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		writeAdminError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	}
+}
+
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method == method {
+		return true
+	}
+	w.Header().Set("Allow", method)
+	writeAdminError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	return false
+}
+
+func writeAdminJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(v)
+}
+
+func writeAdminError(w http.ResponseWriter, status int, err error) {
+	writeAdminJSON(w, status, map[string]string{"error": redactor.redact(err.Error())})
+}
@@ -0,0 +1,522 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/template"
+	"time"
+)
+
+// In agent mode the binary runs inside a pod, as an init container or a
+// sidecar. It logs in to Vault with the pod's service account and writes the
+// secrets declared in CustomSecret manifests to a shared volume, with no
+// Kubernetes Secret or controller involved.
+var (
+	agentMode          = false
+	agentSecrets       = "/etc/secret-agent"
+	agentOutputDir     = "/secrets"
+	agentOnce          = false
+	agentAuthRole      = ""
+	agentAuthMount     = "kubernetes"
+	agentSignal        = "SIGHUP"
+	agentSignalProcess = ""
+	agentFileMode      = "0600"
+)
+
+// agentVaultConnection is the name the agent's Vault connection is registered
+// under, for CustomSecrets that don't name one
+const agentVaultConnection = "(agent)"
+
+// agentSecret is a CustomSecret written by the agent
+type agentSecret struct {
+	Metadata ObjectMeta      `json:"metadata"`
+	Spec     agentSecretSpec `json:"spec"`
+
+	// retryAt is set when processing failed
+	retryAt time.Time
+}
+
+// agentSecretSpec adds templates to a CustomSecretSpec. Each template is
+// rendered with the Vault response data into a file of that name; without
+// templates every key of the data is written to its own file.
+type agentSecretSpec struct {
+	CustomSecretSpec
+	Templates map[string]string `json:"templates,omitempty"`
+}
+
+func (a agentSecret) customSecret() CustomSecret {
+	return CustomSecret{Metadata: a.Metadata, Spec: a.Spec.CustomSecretSpec}
+}
+
+// readAgentSecrets reads the CustomSecrets, or lists of CustomSecrets, in a
+// JSON file or in every .json file of a directory, e.g. a mounted ConfigMap
+func readAgentSecrets(path string) ([]agentSecret, error) {
+	files := []string{path}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		files, err = filepath.Glob(filepath.Join(path, "*.json"))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var secrets []agentSecret
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		var list struct {
+			Items []agentSecret `json:"items"`
+		}
+		err = json.Unmarshal(data, &list)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+		if list.Items == nil {
+			var secret agentSecret
+			err = json.Unmarshal(data, &secret)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", file, err)
+			}
+			list.Items = []agentSecret{secret}
+		}
+		secrets = append(secrets, list.Items...)
+	}
+
+	seen := make(map[string]bool)
+	for _, s := range secrets {
+		if s.Spec.Secret == "" || s.Spec.Policy == "" {
+			return nil, fmt.Errorf("CustomSecret %q must set secret and policy", s.Metadata["name"])
+		}
+		if s.Spec.Secret != filepath.Base(s.Spec.Secret) || strings.HasPrefix(s.Spec.Secret, ".") {
+			return nil, fmt.Errorf("CustomSecret %q: invalid secret name %q", s.Metadata["name"], s.Spec.Secret)
+		}
+		if seen[s.Spec.Secret] {
+			return nil, fmt.Errorf("more than one CustomSecret writes secret %q", s.Spec.Secret)
+		}
+		seen[s.Spec.Secret] = true
+		if s.Spec.WrapTTL != "" {
+			return nil, fmt.Errorf("CustomSecret %q: wrapTTL is not supported in agent mode", s.Metadata["name"])
+		}
+	}
+	if len(secrets) == 0 {
+		return nil, errors.New("no CustomSecrets found in " + path)
+	}
+	return secrets, nil
+}
+
+// runAgent writes every secret once, then, unless running once, keeps their
+// leases renewed and re-issues them as needed until signalled to stop
+func runAgent() error {
+	secrets, err := readAgentSecrets(agentSecrets)
+	if err != nil {
+		return err
+	}
+
+	fileMode, err := strconv.ParseUint(agentFileMode, 8, 32)
+	if err != nil || fileMode&^0666 != 0 {
+		return errors.New("invalid -agent-file-mode " + agentFileMode)
+	}
+
+	var rotationSignal syscall.Signal
+	if agentSignalProcess != "" {
+		rotationSignal, err = parseSignal(agentSignal)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Log in with the pod's service account, unless given a token
+	if vaultToken != "" {
+		client, err := newVaultClient(vaultToken, vaultURL, vaultTLS)
+		if err != nil {
+			return err
+		}
+		vltPool = newVaultClientPool(client)
+	} else {
+		if agentAuthRole == "" {
+			return errors.New("-agent-auth-role is required to log in with the service account")
+		}
+		settingsLock.Lock()
+		fileVaultConnections[agentVaultConnection] = VaultConnectionSpec{
+			Address: vaultURL,
+			TLS:     vaultTLS,
+			Auth:    VaultAuthSpec{Method: "kubernetes", Mount: agentAuthMount, Role: agentAuthRole},
+		}
+		settingsLock.Unlock()
+		vltPool = newVaultClientPool(nil)
+		for i := range secrets {
+			if secrets[i].Spec.VaultConnection == "" {
+				secrets[i].Spec.VaultConnection = agentVaultConnection
+			}
+		}
+	}
+
+	for i := range secrets {
+		err = agentIssue(&secrets[i], os.FileMode(fileMode))
+		if err != nil {
+			return err
+		}
+	}
+	signalMainProcess(rotationSignal)
+
+	if agentOnce {
+		logInfo("Secrets written, exiting", logFields{"output_dir": agentOutputDir})
+		return nil
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	for {
+		deadline := time.Time{}
+		for i := range secrets {
+			if t := agentDeadline(&secrets[i]); deadline.IsZero() || t.Before(deadline) {
+				deadline = t
+			}
+		}
+
+		select {
+		case <-time.After(deadline.Sub(time.Now())):
+		case <-stop:
+			logInfo("Shutdown signal received, revoking leases...", nil)
+			for i := range secrets {
+				agentRevoke(&secrets[i])
+			}
+			return nil
+		}
+
+		rotated := false
+		for i := range secrets {
+			if time.Now().Before(agentDeadline(&secrets[i])) {
+				continue
+			}
+			reissued, err := agentProcess(&secrets[i], os.FileMode(fileMode))
+			if err != nil {
+				logError("Error processing CustomSecret", customSecretFields(secrets[i].customSecret()).with("error", err))
+				secrets[i].retryAt = time.Now().Add(retryInterval)
+				continue
+			}
+			secrets[i].retryAt = time.Time{}
+			if !agentDeadline(&secrets[i]).After(time.Now()) {
+				// Nothing left to do until the lease expires, don't spin
+				secrets[i].retryAt = time.Now().Add(retryInterval)
+			}
+			rotated = rotated || reissued
+		}
+		if rotated {
+			signalMainProcess(rotationSignal)
+		}
+		for i := range secrets {
+			agentRevokePrevious(&secrets[i], false)
+		}
+	}
+}
+
+// agentDeadline returns when a secret next needs renewing or re-issuing.
+// Secrets without a lease are read again every sync interval.
+func agentDeadline(s *agentSecret) time.Time {
+	if !s.retryAt.IsZero() {
+		return s.retryAt
+	}
+	deadline := nextDeadline(s.customSecret(), &s.Spec.CustomSecretSpec)
+	if deadline.IsZero() {
+		deadline = s.Spec.IssueDate.Add(getSyncInterval())
+	}
+	return deadline
+}
+
+// agentProcess renews the lease of a secret, or issues new credentials if
+// it's expired, its max TTL is near or its rotation schedule says so. It
+// returns true if new credentials were written.
+func agentProcess(s *agentSecret, mode os.FileMode) (bool, error) {
+	c := s.customSecret()
+	current := s.Spec.CustomSecretSpec
+
+	if reason, due := scheduledReissue(c, &current); due {
+		logInfo("Re-issuing credentials", customSecretFields(c).withLease(current.LeaseID).with("reason", reason))
+		return true, agentIssue(s, mode)
+	}
+
+	switch nextLeaseAction(&current) {
+	case leaseReissue:
+		logInfo("Lease expired, re-issuing credentials", customSecretFields(c).withLease(current.LeaseID))
+		return true, agentIssue(s, mode)
+	case leaseRenew:
+		logInfo("Renewing lease", customSecretFields(c).withLease(current.LeaseID))
+		vc, err := vltPool.get(c.Spec.VaultConnection)
+		if err != nil {
+			return false, err
+		}
+		_, err = extendLease(&c, vc, &current)
+		if err != nil {
+			return false, err
+		}
+		s.Spec.CustomSecretSpec = c.Spec
+		leaseExpiry.set(c.Spec.Secret, c.Spec.LeaseExpirationDate)
+	}
+	return false, nil
+}
+
+// agentIssue requests new credentials for a secret and writes them. The
+// lease they replace is revoked by agentRevokePrevious once the rotation
+// grace period, if any, has passed.
+func agentIssue(s *agentSecret, mode os.FileMode) error {
+	c := s.customSecret()
+	previous := s.Spec.CustomSecretSpec
+	vc, err := vltPool.get(c.Spec.VaultConnection)
+	if err != nil {
+		return err
+	}
+
+	secret, err := issueLease(&c, vc)
+	if err != nil {
+		return err
+	}
+
+	files, err := renderAgentSecret(s.Spec.Templates, secret.Data)
+	if err == nil {
+		err = writeAtomicDir(filepath.Join(agentOutputDir, c.Spec.Secret), files, mode)
+	}
+	if err != nil {
+		// Don't leave credentials nobody can use behind
+		revokeErr := vc.revokeVaultSecret(secret.LeaseID)
+		auditCustomSecret("revoke", c, secret.LeaseID, nil, revokeErr)
+		return errors.New("[Agent] Error writing secret: " + err.Error())
+	}
+
+	fileData := make(map[string]interface{}, len(files))
+	for k, v := range files {
+		fileData[k] = string(v)
+	}
+	c.Spec.SecretVersion = secretVersion(fileData)
+	s.Spec.CustomSecretSpec = c.Spec
+
+	if previous.LeaseID != "" && time.Now().Before(previous.LeaseExpirationDate) {
+		// Only one previous lease is kept
+		agentRevokePrevious(s, true)
+		s.Spec.PreviousLeaseID = previous.LeaseID
+		s.Spec.PreviousVaultConnection = previous.VaultConnection
+		s.Spec.PreviousRevokeDate = time.Now().Add(rotationGracePeriod(c))
+	}
+	operationsCounter.inc("issue")
+	leaseExpiry.set(c.Spec.Secret, c.Spec.LeaseExpirationDate)
+	logInfo("Secret written", customSecretFields(c).withLease(c.Spec.LeaseID).with("version", c.Spec.SecretVersion))
+	return nil
+}
+
+// agentRevokePrevious revokes the lease replaced by the current credentials
+// of a secret once its grace period has passed, or straight away if force is
+// set. If revoking fails it's retried later.
+func agentRevokePrevious(s *agentSecret, force bool) {
+	if s.Spec.PreviousLeaseID == "" || (!force && time.Now().Before(s.Spec.PreviousRevokeDate)) {
+		return
+	}
+
+	c := s.customSecret()
+	err := revokeLease(c, &CustomSecretSpec{LeaseID: s.Spec.PreviousLeaseID, VaultConnection: s.Spec.PreviousVaultConnection})
+	if err != nil {
+		logWarn("Error revoking previous lease", customSecretFields(c).withLease(s.Spec.PreviousLeaseID).with("error", err))
+		return
+	}
+	s.Spec.PreviousLeaseID = ""
+	s.Spec.PreviousVaultConnection = ""
+	s.Spec.PreviousRevokeDate = time.Time{}
+}
+
+// agentRevoke revokes every lease of a secret when the agent stops, so the
+// credentials of a pod don't outlive it
+func agentRevoke(s *agentSecret) {
+	agentRevokePrevious(s, true)
+
+	c := s.customSecret()
+	err := revokeLease(c, &s.Spec.CustomSecretSpec)
+	if err != nil {
+		logWarn("Error revoking lease", customSecretFields(c).withLease(s.Spec.LeaseID).with("error", err))
+	}
+}
+
+// renderAgentSecret returns the files to write for the data of a Vault
+// response: the rendered templates, or else one file per key
+func renderAgentSecret(templates map[string]string, data map[string]interface{}) (map[string][]byte, error) {
+	files := make(map[string][]byte)
+	if len(templates) == 0 {
+		for k, v := range data {
+			value, err := secretValueString(v)
+			if err != nil {
+				return nil, err
+			}
+			files[k] = []byte(value)
+		}
+		return files, nil
+	}
+
+	for name, text := range templates {
+		if name != filepath.Base(name) || strings.HasPrefix(name, ".") {
+			return nil, fmt.Errorf("invalid template file name %q", name)
+		}
+		t, err := template.New(name).Option("missingkey=error").Parse(text)
+		if err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		err = t.Execute(&buf, data)
+		if err != nil {
+			return nil, err
+		}
+		files[name] = buf.Bytes()
+	}
+	return files, nil
+}
+
+// writeAtomicDir replaces the files in dir the way kubelet updates a secret
+// volume: the files are written to a new hidden directory, the ..data symlink
+// is swapped to point at it, and each file is a symlink through ..data. A
+// reader following ..data never sees a mix of old and new files. Files get
+// mode, and directories can be searched by whoever can read the files.
+func writeAtomicDir(dir string, files map[string][]byte, mode os.FileMode) error {
+	dirMode := 0700 | mode | (mode&0044)>>2
+	err := os.MkdirAll(dir, dirMode)
+	if err != nil {
+		return err
+	}
+
+	version := "..agent_" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	err = os.Mkdir(filepath.Join(dir, version), dirMode)
+	if err != nil {
+		return err
+	}
+	for name, data := range files {
+		err = ioutil.WriteFile(filepath.Join(dir, version, name), data, mode)
+		if err != nil {
+			return err
+		}
+	}
+
+	previous, _ := os.Readlink(filepath.Join(dir, "..data"))
+	tmp := filepath.Join(dir, "..data_tmp")
+	os.Remove(tmp)
+	err = os.Symlink(version, tmp)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp, filepath.Join(dir, "..data"))
+	if err != nil {
+		return err
+	}
+
+	// Link new files through ..data and remove links to files that are gone
+	for name := range files {
+		link := filepath.Join(dir, name)
+		if _, err := os.Lstat(link); os.IsNotExist(err) {
+			err = os.Symlink(filepath.Join("..data", name), link)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if _, ok := files[entry.Name()]; !ok && !strings.HasPrefix(entry.Name(), "..") {
+			os.Remove(filepath.Join(dir, entry.Name()))
+		}
+	}
+
+	if previous != "" && previous != version {
+		os.RemoveAll(filepath.Join(dir, previous))
+	}
+	return nil
+}
+
+// signalMainProcess sends sig to the processes named agentSignalProcess,
+// which are visible when the pod shares its process namespace
+func signalMainProcess(sig syscall.Signal) {
+	if agentSignalProcess == "" {
+		return
+	}
+
+	pids, err := filepath.Glob("/proc/[0-9]*/comm")
+	if err != nil {
+		logWarn("Error listing processes", logFields{"error": err})
+		return
+	}
+	found := false
+	for _, comm := range pids {
+		name, err := ioutil.ReadFile(comm)
+		if err != nil || strings.TrimSpace(string(name)) != agentSignalProcess {
+			continue
+		}
+		pid, err := strconv.Atoi(filepath.Base(filepath.Dir(comm)))
+		if err != nil || pid == os.Getpid() {
+			continue
+		}
+		found = true
+		err = syscall.Kill(pid, sig)
+		if err != nil {
+			logWarn("Error signalling process", logFields{"pid": pid, "signal": sig.String(), "error": err})
+			continue
+		}
+		logInfo("Signalled process", logFields{"pid": pid, "process": agentSignalProcess, "signal": sig.String()})
+	}
+	if !found {
+		logWarn("No process to signal found; is shareProcessNamespace set on the pod?", logFields{"process": agentSignalProcess})
+	}
+}
+
+// parseSignal parses a signal name such as SIGHUP or HUP
+func parseSignal(name string) (syscall.Signal, error) {
+	switch strings.TrimPrefix(strings.ToUpper(name), "SIG") {
+	case "HUP":
+		return syscall.SIGHUP, nil
+	case "INT":
+		return syscall.SIGINT, nil
+	case "QUIT":
+		return syscall.SIGQUIT, nil
+	case "TERM":
+		return syscall.SIGTERM, nil
+	case "USR1":
+		return syscall.SIGUSR1, nil
+	case "USR2":
+		return syscall.SIGUSR2, nil
+	}
+	return 0, errors.New("unknown signal " + name)
+}
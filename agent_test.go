@@ -0,0 +1,90 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRunAgentOnceWithServiceAccount(t *testing.T) {
+	fv := newFakeVault(t)
+	dir, err := ioutil.TempDir("", "kubernetes-secret-manager")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	manifest := `{"metadata":{"name":"app-db"},"spec":{"secret":"app-db","policy":"database/creds/app","templates":{"dsn":"{{.username}}:{{.password}}@db"}}}`
+	files := map[string]string{"secrets.json": manifest, "token": "service-account-jwt"}
+	for name, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	previousSecrets, previousOutput, previousOnce, previousRole := agentSecrets, agentOutputDir, agentOnce, agentAuthRole
+	previousToken, previousURL, previousPath, previousPool := vaultToken, vaultURL, serviceAccountTokenPath, vltPool
+	t.Cleanup(func() {
+		agentSecrets, agentOutputDir, agentOnce, agentAuthRole = previousSecrets, previousOutput, previousOnce, previousRole
+		vaultToken, vaultURL, serviceAccountTokenPath, vltPool = previousToken, previousURL, previousPath, previousPool
+	})
+	// Registered so it's removed again afterwards
+	useFileVaultConnection(t, agentVaultConnection, VaultConnectionSpec{})
+
+	agentSecrets = filepath.Join(dir, "secrets.json")
+	agentOutputDir = filepath.Join(dir, "out")
+	agentOnce = true
+	agentAuthRole = "app"
+	vaultToken = ""
+	vaultURL = fv.URL
+	serviceAccountTokenPath = filepath.Join(dir, "token")
+
+	if err := runAgent(); err != nil {
+		t.Fatalf("runAgent: %v", err)
+	}
+
+	if logins := fv.loginCount(); logins != 1 {
+		t.Errorf("logged in %d times, want once", logins)
+	}
+	fv.Lock()
+	jwt := fv.jwt
+	fv.Unlock()
+	if jwt != "service-account-jwt" {
+		t.Errorf("logged in with jwt %q, want the service account token", jwt)
+	}
+	if !fv.received("GET", "/v1/database/creds/app", "s.token1") {
+		t.Error("credentials weren't issued with the service account's Vault token")
+	}
+	dsn, err := ioutil.ReadFile(filepath.Join(agentOutputDir, "app-db", "dsn"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(dsn) != "app:hunter2hunter2hunter2@db" {
+		t.Errorf("dsn = %q, want the rendered template", dsn)
+	}
+}
@@ -0,0 +1,289 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+var (
+	auditSinkType   = ""
+	auditFile       = ""
+	auditWebhookURL = ""
+
+	// auditLog is nil when auditing is disabled
+	auditLog *auditor
+
+	auditBucket        = []byte("Audit")
+	auditRetryInterval = 10 * time.Second
+)
+
+const (
+	auditSuccess = "success"
+	auditFailure = "failure"
+)
+
+// auditRecord describes one credential operation
+type auditRecord struct {
+	Time            time.Time `json:"time"`
+	Action          string    `json:"action"`
+	Outcome         string    `json:"outcome"`
+	Error           string    `json:"error,omitempty"`
+	Namespace       string    `json:"namespace"`
+	CustomSecret    string    `json:"customsecret"`
+	Secret          string    `json:"secret"`
+	VaultPath       string    `json:"vault_path"`
+	VaultConnection string    `json:"vault_connection,omitempty"`
+	LeaseIDHash     string    `json:"lease_id_hash,omitempty"`
+	LeaseExpiration string    `json:"lease_expiration,omitempty"`
+	Username        string    `json:"username,omitempty"`
+}
+
+// auditSink delivers a single JSON encoded record
+type auditSink interface {
+	write(record []byte) error
+}
+
+// writerSink appends records to a file or stdout, one per line
+type writerSink struct {
+	out io.Writer
+}
+
+func (s *writerSink) write(record []byte) error {
+	_, err := s.out.Write(append(record, '\n'))
+	return err
+}
+
+// webhookSink POSTs each record to a URL
+type webhookSink struct {
+	url    string
+	client *http.Client
+}
+
+func (s *webhookSink) write(record []byte) error {
+	resp, err := s.client.Post(s.url, "application/json", bytes.NewReader(record))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.New("audit webhook: unexpected HTTP status code " + resp.Status)
+	}
+	return nil
+}
+
+func newAuditSink() (auditSink, error) {
+	switch auditSinkType {
+	case "stdout":
+		return &writerSink{os.Stdout}, nil
+	case "file":
+		if auditFile == "" {
+			return nil, errors.New("audit-file is required for the file audit sink")
+		}
+		f, err := os.OpenFile(auditFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return nil, err
+		}
+		return &writerSink{f}, nil
+	case "webhook":
+		if auditWebhookURL == "" {
+			return nil, errors.New("audit-webhook-url is required for the webhook audit sink")
+		}
+		return &webhookSink{auditWebhookURL, &http.Client{Timeout: 10 * time.Second}}, nil
+	}
+	return nil, fmt.Errorf("unknown audit sink: %s", auditSinkType)
+}
+
+// auditor delivers records to the sink in order. Records that can't be
+// delivered are buffered in the Audit bucket of the database and retried
+// until the sink is available again, so none are lost across restarts.
+type auditor struct {
+	sync.Mutex
+	sink auditSink
+	db   *bolt.DB
+
+	// While the sink is unavailable records are buffered straight away,
+	// rather than waiting on the sink for every record.
+	unavailableUntil time.Time
+}
+
+func newAuditor(sink auditSink, db *bolt.DB) *auditor {
+	return &auditor{sink: sink, db: db}
+}
+
+// run retries buffered records until done is closed
+func (a *auditor) run(done chan struct{}) {
+	go func() {
+		for {
+			select {
+			case <-time.After(auditRetryInterval):
+				a.Lock()
+				a.flush()
+				a.Unlock()
+			case <-done:
+				return
+			}
+		}
+	}()
+}
+
+func (a *auditor) record(r auditRecord) {
+	data, err := json.Marshal(r)
+	if err != nil {
+		logError("Error encoding audit record", logFields{"error": err})
+		return
+	}
+
+	a.Lock()
+	defer a.Unlock()
+
+	// Keep records in order: nothing is sent directly while older records
+	// are still buffered
+	if time.Now().After(a.unavailableUntil) && a.flush() {
+		err = a.sink.write(data)
+		if err == nil {
+			return
+		}
+		a.unavailableUntil = time.Now().Add(auditRetryInterval)
+		logWarn("Error writing audit record, buffering", logFields{"error": err})
+	}
+
+	err = a.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(auditBucket)
+		seq, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, seq)
+		return bucket.Put(key, data)
+	})
+	if err != nil {
+		logError("Error buffering audit record", logFields{"error": err})
+	}
+}
+
+// auditFlushBatch is how many buffered records are read at a time
+const auditFlushBatch = 100
+
+// flush sends buffered records to the sink, oldest first, and returns true
+// once the buffer is empty. Records are sent outside of any database
+// transaction, so writers aren't blocked by a slow sink, and each batch is
+// deleted once delivered. The caller must hold the lock.
+func (a *auditor) flush() bool {
+	for {
+		var keys, records [][]byte
+		err := a.db.View(func(tx *bolt.Tx) error {
+			c := tx.Bucket(auditBucket).Cursor()
+			for k, v := c.First(); k != nil && len(keys) < auditFlushBatch; k, v = c.Next() {
+				// Bolt's slices are only valid during the transaction
+				keys = append(keys, append([]byte(nil), k...))
+				records = append(records, append([]byte(nil), v...))
+			}
+			return nil
+		})
+		if err != nil {
+			logError("Error reading buffered audit records", logFields{"error": err})
+			return false
+		}
+		if len(keys) == 0 {
+			return true
+		}
+
+		delivered := 0
+		for _, record := range records {
+			err = a.sink.write(record)
+			if err != nil {
+				break
+			}
+			delivered++
+		}
+
+		if delivered > 0 {
+			deleteErr := a.db.Update(func(tx *bolt.Tx) error {
+				bucket := tx.Bucket(auditBucket)
+				for _, k := range keys[:delivered] {
+					if err := bucket.Delete(k); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			if deleteErr != nil {
+				logError("Error removing delivered audit records", logFields{"error": deleteErr})
+				return false
+			}
+		}
+
+		if err != nil {
+			a.unavailableUntil = time.Now().Add(auditRetryInterval)
+			logWarn("Error flushing buffered audit records", logFields{"error": err})
+			return false
+		}
+	}
+}
+
+// auditCustomSecret records an operation on the credentials of a
+// CustomSecret. data is the secret returned by Vault, if any.
+func auditCustomSecret(action string, c CustomSecret, leaseID string, data map[string]interface{}, err error) {
+	if auditLog == nil {
+		return
+	}
+
+	r := auditRecord{
+		Time:            time.Now().UTC(),
+		Action:          action,
+		Outcome:         auditSuccess,
+		Namespace:       namespace,
+		CustomSecret:    c.Metadata["name"],
+		Secret:          c.Spec.Secret,
+		VaultPath:       c.Spec.Policy,
+		VaultConnection: c.Spec.VaultConnection,
+		LeaseIDHash:     leaseIDHash(leaseID),
+	}
+	if err != nil {
+		r.Outcome = auditFailure
+		r.Error = redactor.redact(err.Error())
+	}
+	if !c.Spec.LeaseExpirationDate.IsZero() && err == nil {
+		r.LeaseExpiration = c.Spec.LeaseExpirationDate.UTC().Format(time.RFC3339)
+	}
+	if username, ok := data["username"].(string); ok {
+		r.Username = username
+	}
+
+	auditLog.record(r)
+}
@@ -0,0 +1,738 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+const commandUsage = `Commands:
+  list                List managed secrets, their state and lease expiry
+  show NAME           Show the lease metadata stored for a secret
+  rotate NAME|-all    Issue new credentials now
+  renew NAME          Renew the lease now
+  revoke NAME         Revoke the lease and issue new credentials
+  resync NAME|-all    Reconcile now rather than at the next sync
+  export [FILE]       Write the state store as JSON to FILE or stdout
+  import [FILE]       Read a state store export from FILE or stdin
+  queue               List CustomSecrets waiting to be processed
+  pause NAMESPACE     Stop reconciling the CustomSecrets in a namespace
+  resume NAMESPACE    Start reconciling them again
+  paused              List paused namespaces
+
+NAME is the name of a CustomSecret or of the Kubernetes secret it manages.
+With -admin-url, commands go through the admin API of a running controller.
+Otherwise they work directly against the database in -data-dir, which can't
+be opened while the controller is running; queue, pause, resume and paused
+need the admin API.
+`
+
+// Flags for running commands against the admin API
+var (
+	adminURL       = ""
+	adminToken     = ""
+	adminClientTLS VaultTLSSpec
+)
+
+// stateExportVersion is the version of the export format
+const stateExportVersion = 1
+
+// stateExport is the JSON document written by export and read by import
+type stateExport struct {
+	Version int                         `json:"version"`
+	Secrets map[string]storedSecretSpec `json:"secrets"`
+}
+
+func newStateExport(secrets map[string]CustomSecretSpec) stateExport {
+	state := stateExport{Version: stateExportVersion, Secrets: make(map[string]storedSecretSpec, len(secrets))}
+	for name, secret := range secrets {
+		state.Secrets[name] = storedSecretSpec(secret)
+	}
+	return state
+}
+
+// secretStatus is a managed secret as shown by list
+type secretStatus struct {
+	Secret          string    `json:"secret"`
+	CustomSecret    string    `json:"customSecret,omitempty"`
+	Namespace       string    `json:"namespace,omitempty"`
+	VaultConnection string    `json:"vaultConnection"`
+	VaultPath       string    `json:"vaultPath"`
+	State           string    `json:"state"`
+	LeaseIDHash     string    `json:"leaseIdHash,omitempty"`
+	Expiration      time.Time `json:"expiration"`
+}
+
+// commandBackend carries out commands, either directly against the database
+// or through the admin API.
+type commandBackend interface {
+	statuses() ([]secretStatus, error)
+	show(name string) (string, *CustomSecretSpec, error)
+	// apply runs rotate, renew, revoke or resync on one secret, or on all of
+	// them if name is empty, and returns the result for each
+	apply(op, name string) (map[string]string, error)
+	exportState() (stateExport, error)
+	importState(state stateExport) error
+	close()
+}
+
+// runCommand runs one of the operator commands given after the flags.
+func runCommand(args []string) error {
+	name := args[0]
+	args = args[1:]
+
+	if name == "help" {
+		fmt.Print(commandUsage)
+		return nil
+	}
+
+	var backend commandBackend
+	var err error
+	if adminURL != "" {
+		backend, err = newAdminBackend()
+	} else {
+		readOnly := name == "list" || name == "show" || name == "export"
+		backend, err = newDBBackend(readOnly)
+	}
+	if err != nil {
+		return err
+	}
+	defer backend.close()
+
+	switch name {
+	case "list":
+		statuses, err := backend.statuses()
+		if err != nil {
+			return err
+		}
+		return listCommand(os.Stdout, statuses)
+	case "show":
+		if len(args) != 1 {
+			return errors.New("usage: show NAME")
+		}
+		secret, spec, err := backend.show(args[0])
+		if err != nil {
+			return err
+		}
+		return showCommand(os.Stdout, secret, spec)
+	case "rotate", "renew", "revoke", "resync":
+		if len(args) != 1 || (args[0] == "-all" && (name == "renew" || name == "revoke")) {
+			return fmt.Errorf("usage: %s NAME", name)
+		}
+		target := args[0]
+		if target == "-all" {
+			target = ""
+		}
+		results, err := backend.apply(name, target)
+		printResults(os.Stdout, results)
+		return err
+	case "export":
+		state, err := backend.exportState()
+		if err != nil {
+			return err
+		}
+		return exportCommand(state, args)
+	case "import":
+		state, err := readStateExport(args)
+		if err != nil {
+			return err
+		}
+		err = backend.importState(state)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Imported %d secrets\n", len(state.Secrets))
+		return nil
+	case "queue", "pause", "resume", "paused":
+		admin, ok := backend.(*adminBackend)
+		if !ok {
+			return fmt.Errorf("%s needs the admin API of a running controller, set -admin-url", name)
+		}
+		return admin.reconciliationCommand(os.Stdout, name, args)
+	}
+
+	fmt.Fprint(os.Stderr, commandUsage)
+	return fmt.Errorf("unknown command %q", name)
+}
+
+// dbBackend works directly against the controller's database
+type dbBackend struct {
+	db *bolt.DB
+}
+
+func newDBBackend(readOnly bool) (*dbBackend, error) {
+	db, err := openCommandDB(readOnly)
+	if err != nil {
+		return nil, err
+	}
+	return &dbBackend{db: db}, nil
+}
+
+func (b *dbBackend) close() {
+	b.db.Close()
+}
+
+func (b *dbBackend) statuses() ([]secretStatus, error) {
+	secrets, err := listSecretsLocal(b.db)
+	if err != nil {
+		return nil, err
+	}
+	return secretStatuses(secrets, nil), nil
+}
+
+func (b *dbBackend) show(name string) (string, *CustomSecretSpec, error) {
+	spec, err := getSecretLocal(name, b.db)
+	if err != nil || spec != nil {
+		return name, spec, err
+	}
+
+	// Also accept the name of the CustomSecret
+	c, err := findCustomSecret(name)
+	if err != nil {
+		return "", nil, err
+	}
+	spec, err = getSecretLocal(c.Spec.Secret, b.db)
+	if err != nil {
+		return "", nil, err
+	}
+	if spec == nil {
+		return "", nil, fmt.Errorf("no state stored for secret %q", c.Spec.Secret)
+	}
+	return c.Spec.Secret, spec, nil
+}
+
+func (b *dbBackend) apply(op, name string) (map[string]string, error) {
+	err := initCommandClients(b.db)
+	if err != nil {
+		return nil, err
+	}
+
+	var customSecrets []CustomSecret
+	if name == "" {
+		customSecrets, err = getCustomSecrets()
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		c, err := findCustomSecret(name)
+		if err != nil {
+			return nil, err
+		}
+		customSecrets = []CustomSecret{*c}
+	}
+
+	operations := map[string]func(CustomSecret, *bolt.DB) error{
+		"rotate": rotateCustomSecret,
+		"renew":  renewCustomSecret,
+		"revoke": revokeCustomSecret,
+		"resync": resyncCustomSecret,
+	}
+
+	results := make(map[string]string)
+	for _, c := range customSecrets {
+		err = operations[op](c, b.db)
+		if err != nil {
+			results[c.Spec.Secret] = redactor.redact(err.Error())
+			continue
+		}
+		results[c.Spec.Secret] = "done"
+	}
+
+	// No controller runs the rollouts queued by rotations, so they're run
+	// before returning
+	rolloutFailed := false
+	for secret, rolled := range rollouts.drain() {
+		for _, r := range rolled {
+			rolloutFailed = rolloutFailed || strings.HasPrefix(r, "failed")
+		}
+		if results[secret] == "done" {
+			results[secret] = "done, " + strings.Join(rolled, ", ")
+		}
+	}
+
+	if err != nil && len(customSecrets) == 1 {
+		return nil, err
+	}
+	for _, result := range results {
+		if !strings.HasPrefix(result, "done") {
+			return results, errors.New(op + " failed for some secrets")
+		}
+	}
+	if rolloutFailed {
+		return results, errors.New("restarting some workloads failed")
+	}
+	return results, nil
+}
+
+func (b *dbBackend) exportState() (stateExport, error) {
+	secrets, err := listSecretsLocal(b.db)
+	return newStateExport(secrets), err
+}
+
+func (b *dbBackend) importState(state stateExport) error {
+	return importState(state, b.db)
+}
+
+// adminBackend sends commands to the admin API of a running controller
+type adminBackend struct {
+	client *http.Client
+}
+
+func newAdminBackend() (*adminBackend, error) {
+	redactor.add(adminToken)
+
+	tlsConfig, err := newVaultTLSConfig(adminClientTLS)
+	if err != nil {
+		return nil, err
+	}
+	return &adminBackend{
+		client: &http.Client{
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+			// Rotating every secret can take a while
+			Timeout: 10 * time.Minute,
+		},
+	}, nil
+}
+
+func (b *adminBackend) close() {}
+
+// do sends a request to the admin API and decodes the JSON response into v.
+// Responses with an error status are returned as errors, after decoding.
+func (b *adminBackend) do(method, endpoint string, body, v interface{}) error {
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, strings.TrimSuffix(adminURL, "/")+endpoint, reqBody)
+	if err != nil {
+		return err
+	}
+	if adminToken != "" {
+		req.Header.Set("Authorization", "Bearer "+adminToken)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode >= 300 {
+		var apiErr struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(data, &apiErr) == nil && apiErr.Error != "" {
+			return errors.New(apiErr.Error)
+		}
+		// Operations on every secret report the result for each
+		if v != nil {
+			json.Unmarshal(data, v)
+		}
+		return errors.New("admin API: " + resp.Status)
+	}
+	if v == nil {
+		return nil
+	}
+	return json.Unmarshal(data, v)
+}
+
+func (b *adminBackend) statuses() ([]secretStatus, error) {
+	var statuses []secretStatus
+	err := b.do("GET", "/v1/secrets", nil, &statuses)
+	return statuses, err
+}
+
+func (b *adminBackend) show(name string) (string, *CustomSecretSpec, error) {
+	var stored storedSecretSpec
+	err := b.do("GET", "/v1/secrets/"+url.PathEscape(name), nil, &stored)
+	if err != nil {
+		return "", nil, err
+	}
+	spec := CustomSecretSpec(stored)
+	return spec.Secret, &spec, nil
+}
+
+func (b *adminBackend) apply(op, name string) (map[string]string, error) {
+	endpoint := "/v1/" + op
+	if name != "" {
+		endpoint = "/v1/secrets/" + url.PathEscape(name) + "/" + op
+	}
+
+	results := make(map[string]string)
+	err := b.do("POST", endpoint, nil, &results)
+	return results, err
+}
+
+func (b *adminBackend) exportState() (stateExport, error) {
+	var state stateExport
+	err := b.do("GET", "/v1/state", nil, &state)
+	return state, err
+}
+
+func (b *adminBackend) importState(state stateExport) error {
+	return b.do("PUT", "/v1/state", state, nil)
+}
+
+// reconciliationCommand runs the commands only available through the API
+func (b *adminBackend) reconciliationCommand(w io.Writer, name string, args []string) error {
+	switch name {
+	case "queue":
+		var entries []queueEntry
+		err := b.do("GET", "/v1/queue", nil, &entries)
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "CUSTOMSECRET\tNAMESPACE\tSECRET\tSOURCE\tQUEUED")
+		for _, e := range entries {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", e.CustomSecret, e.Namespace, e.Secret, e.Source, e.Queued.Format(time.RFC3339))
+		}
+		return tw.Flush()
+	case "pause", "resume":
+		if len(args) != 1 {
+			return fmt.Errorf("usage: %s NAMESPACE", name)
+		}
+		err := b.do("POST", "/v1/namespaces/"+url.PathEscape(args[0])+"/"+name, nil, nil)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%s: %sd\n", args[0], name)
+		return nil
+	default:
+		var paused map[string]time.Time
+		err := b.do("GET", "/v1/namespaces", nil, &paused)
+		if err != nil {
+			return err
+		}
+		namespaces := make([]string, 0, len(paused))
+		for ns := range paused {
+			namespaces = append(namespaces, ns)
+		}
+		sort.Strings(namespaces)
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "NAMESPACE\tPAUSED SINCE")
+		for _, ns := range namespaces {
+			fmt.Fprintf(tw, "%s\t%s\n", ns, paused[ns].Format(time.RFC3339))
+		}
+		return tw.Flush()
+	}
+}
+
+// openCommandDB opens the controller's database. Bolt allows a single writer,
+// so this fails quickly rather than waiting on a running controller.
+func openCommandDB(readOnly bool) (*bolt.DB, error) {
+	dbPath := path.Join(dataDir, "data.db")
+	if readOnly {
+		_, err := os.Stat(dbPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	db, err := bolt.Open(dbPath, 0600, &bolt.Options{ReadOnly: readOnly, Timeout: time.Second})
+	if err == bolt.ErrTimeout {
+		return nil, fmt.Errorf("%s is in use, stop the controller first", dbPath)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if !readOnly {
+		err = createBuckets(db)
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	return db, nil
+}
+
+// initCommandClients sets up the Vault clients and audit log the way the
+// controller does, for commands that change credentials.
+func initCommandClients(db *bolt.DB) error {
+	vltClient, err := newVaultClient(vaultToken, vaultURL, vaultTLS)
+	if err != nil {
+		return err
+	}
+	vltPool = newVaultClientPool(vltClient)
+
+	if auditSinkType != "" {
+		sink, err := newAuditSink()
+		if err != nil {
+			return err
+		}
+		// Records that can't be delivered are buffered in the database and
+		// sent by the controller once it's running again
+		auditLog = newAuditor(sink, db)
+	}
+	return nil
+}
+
+// secretStatuses describes the secrets stored locally. If customSecrets is
+// given, CustomSecrets without stored state are included as pending.
+func secretStatuses(secrets map[string]CustomSecretSpec, customSecrets []CustomSecret) []secretStatus {
+	statuses := make(map[string]secretStatus)
+	for name, s := range secrets {
+		status := secretStatus{
+			Secret:          name,
+			VaultConnection: connectionName(s.VaultConnection),
+			VaultPath:       s.Policy,
+			LeaseIDHash:     leaseIDHash(s.LeaseID),
+			Expiration:      s.LeaseExpirationDate,
+		}
+		spec := s
+		switch {
+		case s.WrapTTL != "" && wrapValid(&spec):
+			status.State = "wrapped"
+			status.Expiration = s.WrapExpirationDate
+		case s.WrapTTL != "":
+			status.State = "wrap expired"
+			status.Expiration = s.WrapExpirationDate
+		default:
+			status.State = leaseStates[nextLeaseAction(&spec)]
+		}
+		statuses[name] = status
+	}
+
+	for _, c := range customSecrets {
+		status, ok := statuses[c.Spec.Secret]
+		if !ok {
+			status = secretStatus{
+				Secret:          c.Spec.Secret,
+				VaultConnection: connectionName(c.Spec.VaultConnection),
+				VaultPath:       c.Spec.Policy,
+				State:           "pending",
+			}
+		}
+		status.CustomSecret = c.Metadata["name"]
+		status.Namespace = customSecretNamespace(c)
+		if pausedNamespaces.isPaused(status.Namespace) {
+			status.State = "paused"
+		}
+		statuses[c.Spec.Secret] = status
+	}
+
+	names := make([]string, 0, len(statuses))
+	for name := range statuses {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	list := make([]secretStatus, 0, len(names))
+	for _, name := range names {
+		list = append(list, statuses[name])
+	}
+	return list
+}
+
+// leaseStates describes the result of nextLeaseAction
+var leaseStates = map[string]string{
+	leaseIssue:   "pending",
+	leaseReissue: "expired",
+	leaseRenew:   "renewal due",
+	leaseValid:   "valid",
+}
+
+func listCommand(w io.Writer, statuses []secretStatus) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "SECRET\tCUSTOMSECRET\tCONNECTION\tVAULT PATH\tSTATE\tLEASE\tEXPIRES\tREMAINING")
+	for _, s := range statuses {
+		expires, left := "-", "-"
+		if !s.Expiration.IsZero() {
+			expires = s.Expiration.UTC().Format(time.RFC3339)
+			left = remaining(s.Expiration)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", s.Secret, orDash(s.CustomSecret), s.VaultConnection,
+			s.VaultPath, s.State, orDash(s.LeaseIDHash), expires, left)
+	}
+	return tw.Flush()
+}
+
+func showCommand(w io.Writer, name string, s *CustomSecretSpec) error {
+	method := s.Method
+	if method == "" {
+		method = "read"
+	}
+	params := make([]string, 0, len(s.Parameters))
+	for k := range s.Parameters {
+		params = append(params, k)
+	}
+	sort.Strings(params)
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "Secret:\t%s\n", name)
+	fmt.Fprintf(tw, "Vault connection:\t%s\n", connectionName(s.VaultConnection))
+	fmt.Fprintf(tw, "Vault path:\t%s\n", s.Policy)
+	fmt.Fprintf(tw, "Method:\t%s\n", method)
+	if len(params) > 0 {
+		fmt.Fprintf(tw, "Parameters:\t%s (values not shown)\n", strings.Join(params, ", "))
+	}
+	if s.WrapTTL != "" {
+		fmt.Fprintf(tw, "Wrap TTL:\t%s\n", s.WrapTTL)
+		fmt.Fprintf(tw, "Wrap expiration:\t%s (%s)\n", s.WrapExpirationDate.UTC().Format(time.RFC3339), remaining(s.WrapExpirationDate))
+		return tw.Flush()
+	}
+	if s.RotationSchedule != "" {
+		fmt.Fprintf(tw, "Rotation schedule:\t%s\n", s.RotationSchedule)
+	}
+	if s.MaintenanceWindow != nil {
+		fmt.Fprintf(tw, "Maintenance window:\t%s for %s\n", s.MaintenanceWindow.Start, s.MaintenanceWindow.Duration)
+	}
+	if !s.IssueDate.IsZero() {
+		fmt.Fprintf(tw, "Issued:\t%s\n", s.IssueDate.UTC().Format(time.RFC3339))
+	}
+	if hardExpiry := hardExpiration(s); !hardExpiry.IsZero() {
+		fmt.Fprintf(tw, "Max TTL expiration:\t%s (%s)\n", hardExpiry.UTC().Format(time.RFC3339), remaining(hardExpiry))
+	}
+	if s.TTL != "" {
+		fmt.Fprintf(tw, "Requested TTL:\t%s\n", s.TTL)
+	}
+	if s.RenewIncrement != "" {
+		fmt.Fprintf(tw, "Renew increment:\t%s\n", s.RenewIncrement)
+	}
+	fmt.Fprintf(tw, "Lease ID:\t%s\n", s.LeaseID)
+	fmt.Fprintf(tw, "Lease ID hash:\t%s\n", leaseIDHash(s.LeaseID))
+	fmt.Fprintf(tw, "Lease duration:\t%s\n", time.Duration(s.LeaseDuration)*time.Second)
+	fmt.Fprintf(tw, "Lease expiration:\t%s (%s)\n", s.LeaseExpirationDate.UTC().Format(time.RFC3339), remaining(s.LeaseExpirationDate))
+	if !s.RenewAt.IsZero() {
+		fmt.Fprintf(tw, "Renewal:\t%s (%s)\n", s.RenewAt.UTC().Format(time.RFC3339), remaining(s.RenewAt))
+	}
+	fmt.Fprintf(tw, "Next action:\t%s\n", nextLeaseAction(s))
+	if s.PreviousLeaseID != "" {
+		fmt.Fprintf(tw, "Previous lease ID:\t%s\n", s.PreviousLeaseID)
+		fmt.Fprintf(tw, "Previous lease revoked:\t%s (%s)\n", s.PreviousRevokeDate.UTC().Format(time.RFC3339), remaining(s.PreviousRevokeDate))
+	}
+	return tw.Flush()
+}
+
+func printResults(w io.Writer, results map[string]string) {
+	names := make([]string, 0, len(results))
+	for name := range results {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "%s: %s\n", name, results[name])
+	}
+}
+
+func exportCommand(state stateExport, args []string) error {
+	var w io.Writer = os.Stdout
+	if len(args) > 0 && args[0] != "-" {
+		f, err := os.OpenFile(args[0], os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(state)
+}
+
+func readStateExport(args []string) (stateExport, error) {
+	var state stateExport
+	var r io.Reader = os.Stdin
+	if len(args) > 0 && args[0] != "-" {
+		f, err := os.Open(args[0])
+		if err != nil {
+			return state, err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	err := json.NewDecoder(r).Decode(&state)
+	return state, err
+}
+
+// importState stores every secret in state, replacing any stored under the
+// same name
+func importState(state stateExport, db *bolt.DB) error {
+	if state.Version != stateExportVersion {
+		return fmt.Errorf("unsupported export version %d", state.Version)
+	}
+
+	for name, secret := range state.Secrets {
+		err := persistSecretLocal(name, CustomSecretSpec(secret), db)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func connectionName(name string) string {
+	if name == "" {
+		return defaultVaultConnection
+	}
+	return name
+}
+
+// remaining formats the time left until t, rounded to the second
+func remaining(t time.Time) string {
+	d := t.Sub(time.Now())
+	if d <= 0 {
+		return "expired"
+	}
+	return (d - d%time.Second).String()
+}
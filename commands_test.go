@@ -0,0 +1,106 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCustomSecretStateNotReadFromSpec(t *testing.T) {
+	manifest := `{"metadata":{"name":"app"},"spec":{
+		"policy":"database/creds/app","secret":"app",
+		"leastId":"database/creds/app/forged","renewAt":"2000-01-01T00:00:00Z",
+		"hardExpirationDate":"2000-01-01T00:00:00Z","rotateRequested":true,
+		"previousLeaseId":"database/creds/app/other","maxTTL":60,"secretVersion":"abc"}}`
+
+	var c CustomSecret
+	if err := json.Unmarshal([]byte(manifest), &c); err != nil {
+		t.Fatal(err)
+	}
+	want := CustomSecretSpec{Policy: "database/creds/app", Secret: "app"}
+	if c.Spec.Policy != want.Policy || c.Spec.Secret != want.Secret {
+		t.Fatalf("spec wasn't read: %+v", c.Spec)
+	}
+	if !reflect.DeepEqual(c.Spec, want) {
+		t.Errorf("state was read from the CustomSecret: %+v", c.Spec)
+	}
+}
+
+func TestStateExportKeepsState(t *testing.T) {
+	db := openTestDB(t)
+	now := time.Now().UTC().Truncate(time.Second)
+	spec := CustomSecretSpec{
+		Policy: "database/creds/app", Secret: "app",
+		LeaseID: "database/creds/app/1", LeaseToken: "s.issuer", LeaseDuration: 3600,
+		LeaseExpirationDate: now.Add(time.Hour), RenewAt: now.Add(30 * time.Minute), IssueDate: now,
+		MaxTTL: 86400, HardExpirationDate: now.Add(24 * time.Hour), RotateRequested: true, SecretVersion: "abc",
+		PreviousLeaseID: "database/creds/app/0", PreviousRevokeDate: now.Add(time.Minute),
+	}
+
+	dir, err := ioutil.TempDir("", "kubernetes-secret-manager")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	file := filepath.Join(dir, "state.json")
+	if err := exportCommand(newStateExport(map[string]CustomSecretSpec{"app": spec}), []string{file}); err != nil {
+		t.Fatal(err)
+	}
+	state, err := readStateExport([]string{file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := importState(state, db); err != nil {
+		t.Fatal(err)
+	}
+
+	imported, err := getSecretLocal("app", db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imported == nil {
+		t.Fatal("secret wasn't imported")
+	}
+	got, want := storedSecretSpec(*imported), storedSecretSpec(spec)
+	for _, times := range [][2]*time.Time{
+		{&got.LeaseExpirationDate, &want.LeaseExpirationDate}, {&got.RenewAt, &want.RenewAt},
+		{&got.IssueDate, &want.IssueDate}, {&got.HardExpirationDate, &want.HardExpirationDate},
+		{&got.PreviousRevokeDate, &want.PreviousRevokeDate},
+	} {
+		if !times[0].Equal(*times[1]) {
+			t.Errorf("time changed from %s to %s", times[1], times[0])
+		}
+		*times[0], *times[1] = time.Time{}, time.Time{}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("state changed by export and import:\ngot  %+v\nwant %+v", got, want)
+	}
+}
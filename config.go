@@ -0,0 +1,347 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/hcl"
+	"github.com/hashicorp/hcl/hcl/ast"
+)
+
+// Settings are read, lowest precedence first, from the config file, from
+// SECRET_MANAGER_* environment variables and from command line flags. Every
+// flag can be set in the config file using its name with underscores, e.g.
+// sync_interval for -sync-interval.
+var (
+	configFile         = ""
+	configPollInterval = 10 * time.Second
+	envPrefix          = "SECRET_MANAGER_"
+
+	// commandLineFlags are the flags set on the command line. They're
+	// recorded before loadConfig sets the others, so a reload can tell them
+	// apart from values read from the config file or environment.
+	commandLineFlags = make(map[string]bool)
+)
+
+// reloadableFlags are the settings which can change without a restart
+var reloadableFlags = map[string]bool{
+	"sync-interval": true,
+	"watch-window":  true,
+	"log-level":     true,
+	"log-format":    true,
+}
+
+var (
+	settingsLock    sync.RWMutex
+	currentSettings reloadableSettings
+
+	// vaultConnections defined in the config file, keyed by name
+	fileVaultConnections = make(map[string]VaultConnectionSpec)
+)
+
+type reloadableSettings struct {
+	syncInterval int
+	watchWindow  time.Duration
+	logLevel     string
+	logFormat    string
+}
+
+func (s reloadableSettings) validate() error {
+	if s.syncInterval <= 0 {
+		return errors.New("sync-interval must be greater than 0")
+	}
+	if s.watchWindow <= 0 {
+		return errors.New("watch-window must be greater than 0")
+	}
+	if !validLogLevel(s.logLevel) {
+		return fmt.Errorf("unknown log level: %s", s.logLevel)
+	}
+	if s.logFormat != "text" && s.logFormat != "json" {
+		return fmt.Errorf("unknown log format: %s", s.logFormat)
+	}
+	return nil
+}
+
+func applySettings(s reloadableSettings) {
+	settingsLock.Lock()
+	currentSettings = s
+	settingsLock.Unlock()
+
+	setLogLevel(s.logLevel)
+	setLogFormat(s.logFormat)
+}
+
+func getSyncInterval() time.Duration {
+	settingsLock.RLock()
+	defer settingsLock.RUnlock()
+	return time.Duration(currentSettings.syncInterval) * time.Second
+}
+
+func getWatchWindow() time.Duration {
+	settingsLock.RLock()
+	defer settingsLock.RUnlock()
+	return currentSettings.watchWindow
+}
+
+func getFileVaultConnection(name string) (VaultConnectionSpec, bool) {
+	settingsLock.RLock()
+	defer settingsLock.RUnlock()
+	spec, ok := fileVaultConnections[name]
+	return spec, ok
+}
+
+func getFileVaultConnections() []VaultConnection {
+	settingsLock.RLock()
+	defer settingsLock.RUnlock()
+
+	var vaultConnections []VaultConnection
+	for name, spec := range fileVaultConnections {
+		vaultConnections = append(vaultConnections, VaultConnection{
+			Metadata: map[string]string{"name": name},
+			Spec:     spec,
+		})
+	}
+	return vaultConnections
+}
+
+// loadConfig applies the config file and environment variables on top of
+// the flags at startup. Flags set on the command line always win.
+func loadConfig() error {
+	values, vaultConnections, err := readSettings()
+	if err != nil {
+		return err
+	}
+
+	for name, value := range values {
+		if commandLineFlags[name] {
+			continue
+		}
+		err = flag.Set(name, value)
+		if err != nil {
+			return fmt.Errorf("invalid value for %s: %v", name, err)
+		}
+	}
+
+	s := reloadableSettings{
+		syncInterval: syncIntervalSecs,
+		watchWindow:  watchWindow,
+		logLevel:     logLevel,
+		logFormat:    logFormat,
+	}
+	err = s.validate()
+	if err != nil {
+		return err
+	}
+
+	applySettings(s)
+
+	settingsLock.Lock()
+	fileVaultConnections = vaultConnections
+	settingsLock.Unlock()
+
+	return nil
+}
+
+// reloadConfig re-reads the config file and environment variables and
+// applies the reloadable settings. If anything is invalid the current
+// settings are kept.
+func reloadConfig() {
+	values, vaultConnections, err := readSettings()
+	if err != nil {
+		logError("Error reloading config, keeping current settings", logFields{"error": err})
+		return
+	}
+
+	settingsLock.RLock()
+	s := currentSettings
+	settingsLock.RUnlock()
+
+	for name, value := range values {
+		if commandLineFlags[name] {
+			continue
+		}
+		if !reloadableFlags[name] {
+			if flag.Lookup(name).Value.String() != value {
+				logWarn("Setting changed in config, restart to apply", logFields{"setting": name})
+			}
+			continue
+		}
+
+		switch name {
+		case "sync-interval":
+			s.syncInterval, err = strconv.Atoi(value)
+		case "watch-window":
+			s.watchWindow, err = time.ParseDuration(value)
+		case "log-level":
+			s.logLevel = value
+		case "log-format":
+			s.logFormat = value
+		}
+		if err != nil {
+			logError("Error reloading config, keeping current settings",
+				logFields{"setting": name, "error": err})
+			return
+		}
+	}
+
+	err = s.validate()
+	if err != nil {
+		logError("Error reloading config, keeping current settings", logFields{"error": err})
+		return
+	}
+
+	applySettings(s)
+
+	settingsLock.Lock()
+	fileVaultConnections = vaultConnections
+	settingsLock.Unlock()
+
+	logInfo("Config reloaded", nil)
+}
+
+// watchConfigFile reloads the config when the file changes on disk
+func watchConfigFile(done chan struct{}) {
+	modTime := configModTime()
+	go func() {
+		for {
+			select {
+			case <-time.After(configPollInterval):
+				current := configModTime()
+				if !current.Equal(modTime) {
+					modTime = current
+					reloadConfig()
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+}
+
+func configModTime() time.Time {
+	fi, err := os.Stat(configFile)
+	if err != nil {
+		return time.Time{}
+	}
+	return fi.ModTime()
+}
+
+// readSettings returns the settings from the config file and environment
+// variables, keyed by flag name, along with the Vault connections defined in
+// the config file.
+func readSettings() (map[string]string, map[string]VaultConnectionSpec, error) {
+	values := make(map[string]string)
+	vaultConnections := make(map[string]VaultConnectionSpec)
+
+	if configFile != "" {
+		var err error
+		values, vaultConnections, err = readConfigFile(configFile)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	flag.VisitAll(func(f *flag.Flag) {
+		env := envPrefix + strings.ToUpper(strings.Replace(f.Name, "-", "_", -1))
+		if value, ok := os.LookupEnv(env); ok {
+			values[f.Name] = value
+		}
+	})
+	delete(values, "config")
+
+	return values, vaultConnections, nil
+}
+
+func readConfigFile(path string) (map[string]string, map[string]VaultConnectionSpec, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	file, err := hcl.ParseBytes(data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	root, ok := file.Node.(*ast.ObjectList)
+	if !ok {
+		return nil, nil, errors.New("config: file doesn't contain a root object")
+	}
+
+	values := make(map[string]string)
+	vaultConnections := make(map[string]VaultConnectionSpec)
+	for _, item := range root.Items {
+		key := item.Keys[0].Token.Value().(string)
+
+		if key == "vault_connection" {
+			if len(item.Keys) != 2 {
+				return nil, nil, errors.New("config: vault_connection must have a name")
+			}
+			name := item.Keys[1].Token.Value().(string)
+
+			var spec VaultConnectionSpec
+			err = hcl.DecodeObject(&spec, item.Val)
+			if err != nil {
+				return nil, nil, fmt.Errorf("config: vault_connection %s: %v", name, err)
+			}
+			if spec.Address == "" {
+				return nil, nil, fmt.Errorf("config: vault_connection %s: address is required", name)
+			}
+			vaultConnections[name] = spec
+			continue
+		}
+
+		name := strings.Replace(key, "_", "-", -1)
+		if flag.Lookup(name) == nil || name == "config" || len(item.Keys) != 1 {
+			return nil, nil, fmt.Errorf("config: unknown setting %s", key)
+		}
+		literal, ok := item.Val.(*ast.LiteralType)
+		if !ok {
+			return nil, nil, fmt.Errorf("config: %s must be a single value", key)
+		}
+		values[name] = fmt.Sprint(literal.Token.Value())
+	}
+
+	return values, vaultConnections, nil
+}
+
+// explicitFlags returns the flags that have been set. Called right after
+// flag.Parse, these are the flags set on the command line.
+func explicitFlags() map[string]bool {
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+	return explicit
+}
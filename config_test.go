@@ -0,0 +1,99 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// registerReloadableFlags defines the reloadable flags as main does
+func registerReloadableFlags() {
+	if flag.Lookup("sync-interval") != nil {
+		return
+	}
+	flag.IntVar(&syncIntervalSecs, "sync-interval", syncIntervalSecs, "")
+	flag.DurationVar(&watchWindow, "watch-window", watchWindow, "")
+	flag.StringVar(&logLevel, "log-level", logLevel, "")
+	flag.StringVar(&logFormat, "log-format", logFormat, "")
+}
+
+func TestReloadConfigKeepsCommandLineFlags(t *testing.T) {
+	captureLogs(t)
+	registerReloadableFlags()
+
+	dir, err := ioutil.TempDir("", "kubernetes-secret-manager")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "config.hcl")
+	writeConfig := func(config string) {
+		if err := ioutil.WriteFile(path, []byte(config), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	previousFile, previousFlags, previousLevel := configFile, commandLineFlags, logLevel
+	settingsLock.RLock()
+	previousSettings := currentSettings
+	settingsLock.RUnlock()
+	t.Cleanup(func() {
+		configFile, commandLineFlags = previousFile, previousFlags
+		flag.Set("log-level", previousLevel)
+		setLogLevel(previousLevel)
+		settingsLock.Lock()
+		currentSettings = previousSettings
+		settingsLock.Unlock()
+	})
+	configFile = path
+
+	// Started with -log-level warn
+	if err := flag.Set("log-level", "warn"); err != nil {
+		t.Fatal(err)
+	}
+	commandLineFlags = map[string]bool{"log-level": true}
+
+	writeConfig("sync_interval = 30\nlog_level = \"debug\"\n")
+	if err := loadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if getSyncInterval() != 30*time.Second || currentSettings.logLevel != "warn" {
+		t.Fatalf("loaded sync interval %s, log level %s", getSyncInterval(), currentSettings.logLevel)
+	}
+
+	writeConfig("sync_interval = 45\nlog_level = \"error\"\n")
+	reloadConfig()
+	if getSyncInterval() != 45*time.Second {
+		t.Errorf("sync interval from the config file was not reloaded: %s", getSyncInterval())
+	}
+	if currentSettings.logLevel != "warn" {
+		t.Errorf("log level set on the command line was overridden: %s", currentSettings.logLevel)
+	}
+}
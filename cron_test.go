@@ -0,0 +1,141 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func cronTime(t *testing.T, value string) time.Time {
+	parsed, err := time.Parse("2006-01-02 15:04", value)
+	if err != nil {
+		t.Fatalf("parsing %q: %v", value, err)
+	}
+	return parsed
+}
+
+func TestCronScheduleNext(t *testing.T) {
+	tests := []struct {
+		name string
+		expr string
+		from string
+		want string
+	}{
+		{"every minute", "* * * * *", "2026-01-01 00:07", "2026-01-01 00:08"},
+		{"strictly after a match", "7 0 * * *", "2026-01-01 00:07", "2026-01-02 00:07"},
+		{"step", "*/15 * * * *", "2026-01-01 00:07", "2026-01-01 00:15"},
+		{"step from a value", "5/20 * * * *", "2026-01-01 00:06", "2026-01-01 00:25"},
+		{"range with step", "0 1-10/3 * * *", "2026-01-01 02:00", "2026-01-01 04:00"},
+		{"list", "30 2 1,15 * *", "2026-01-02 03:00", "2026-01-15 02:30"},
+		{"weekday range", "0 9 * * 1-5", "2026-01-02 10:00", "2026-01-05 09:00"},
+		{"7 is sunday", "0 0 * * 7", "2026-01-01 00:00", "2026-01-04 00:00"},
+		{"0 is sunday", "0 0 * * 0", "2026-01-01 00:00", "2026-01-04 00:00"},
+		{"day of month or day of week matches the day of month", "0 0 13 * 1", "2026-02-10 00:00", "2026-02-13 00:00"},
+		{"day of month or day of week matches the day of week", "0 0 13 * 1", "2026-02-13 00:00", "2026-02-16 00:00"},
+		{"wildcard day of month needs the day of week", "0 0 * 2 1", "2026-01-31 00:00", "2026-02-02 00:00"},
+		{"wildcard day of week needs the day of month", "0 0 13 * *", "2026-02-10 00:00", "2026-02-13 00:00"},
+		{"across a month", "30 2 1,15 * *", "2026-01-15 03:00", "2026-02-01 02:30"},
+		{"skips short months", "0 12 31 * *", "2026-01-31 13:00", "2026-03-31 12:00"},
+		{"across a year", "0 0 1 1 *", "2026-06-01 00:00", "2027-01-01 00:00"},
+		{"last minute of the year", "59 23 31 12 *", "2026-12-31 23:59", "2027-12-31 23:59"},
+		{"leap day", "0 0 29 2 *", "2026-03-01 00:00", "2028-02-29 00:00"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			schedule, err := parseCronSchedule(test.expr)
+			if err != nil {
+				t.Fatalf("parsing %q: %v", test.expr, err)
+			}
+			got := schedule.next(cronTime(t, test.from))
+			if want := cronTime(t, test.want); !got.Equal(want) {
+				t.Errorf("next(%s) for %q = %s, want %s", test.from, test.expr, got, want)
+			}
+		})
+	}
+}
+
+func TestCronScheduleNextNever(t *testing.T) {
+	schedule, err := parseCronSchedule("0 0 30 2 *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := schedule.next(cronTime(t, "2026-01-01 00:00")); !got.IsZero() {
+		t.Errorf("next for February 30th = %s, want the zero time", got)
+	}
+}
+
+func TestCronSchedulePrev(t *testing.T) {
+	tests := []struct {
+		name string
+		expr string
+		from string
+		want string
+	}{
+		{"at a match", "0 0 1 * *", "2026-03-01 00:00", "2026-03-01 00:00"},
+		{"within a month", "0 0 1 * *", "2026-03-15 10:00", "2026-03-01 00:00"},
+		{"across a month", "0 12 31 * *", "2026-03-30 00:00", "2026-01-31 12:00"},
+		{"across a year", "0 0 * 12 *", "2026-03-01 00:00", "2025-12-31 00:00"},
+		{"day of week", "45 17 * * 5", "2026-01-05 09:00", "2026-01-02 17:45"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			schedule, err := parseCronSchedule(test.expr)
+			if err != nil {
+				t.Fatalf("parsing %q: %v", test.expr, err)
+			}
+			got := schedule.prev(cronTime(t, test.from))
+			if want := cronTime(t, test.want); !got.Equal(want) {
+				t.Errorf("prev(%s) for %q = %s, want %s", test.from, test.expr, got, want)
+			}
+		})
+	}
+}
+
+func TestParseCronScheduleInvalid(t *testing.T) {
+	tests := []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"*/x * * * *",
+		"5-1 * * * *",
+		"1-2-3 * * * *",
+		"-1 * * * *",
+		"0-60 * * * *",
+		"a * * * *",
+		"1,,2 * * * *",
+	}
+	for _, expr := range tests {
+		if _, err := parseCronSchedule(expr); err == nil {
+			t.Errorf("parseCronSchedule(%q) succeeded, want an error", expr)
+		}
+	}
+}
@@ -27,14 +27,26 @@ package main
 import (
 	"bytes"
 	"encoding/gob"
+	"fmt"
 
 	"github.com/boltdb/bolt"
 )
 
+func init() {
+	// Parameters decoded from the CustomSecret JSON hold these types in
+	// interface values, so gob must know about them to persist the spec.
+	gob.Register(map[string]interface{}{})
+	gob.Register([]interface{}{})
+}
+
 func getSecretLocal(name string, db *bolt.DB) (*CustomSecretSpec, error) {
 	var secret *CustomSecretSpec
 	err := db.View(func(tx *bolt.Tx) error {
-		data := tx.Bucket([]byte("Secrets")).Get([]byte(name))
+		bucket := tx.Bucket([]byte("Secrets"))
+		if bucket == nil {
+			return nil
+		}
+		data := bucket.Get([]byte(name))
 		if data == nil {
 			return nil
 		}
@@ -43,12 +55,21 @@ func getSecretLocal(name string, db *bolt.DB) (*CustomSecretSpec, error) {
 		if err != nil {
 			return err
 		}
+		registerStoredSecret(secret)
 		return nil
 	})
 	return secret, err
 }
 
+// registerStoredSecret makes sure the lease IDs of a secret stored locally
+// are never logged, including after a restart when they haven't been seen
+// in a Vault response.
+func registerStoredSecret(secret *CustomSecretSpec) {
+	redactor.add(secret.LeaseID, secret.LeaseToken, secret.PreviousLeaseID, secret.PreviousLeaseToken, secret.PreviousWrapToken)
+}
+
 func persistSecretLocal(name string, customSecret CustomSecretSpec, db *bolt.DB) error {
+	registerStoredSecret(&customSecret)
 
 	data := new(bytes.Buffer)
 	enc := gob.NewEncoder(data)
@@ -77,3 +98,51 @@ func deleteSecretLocal(secretName string, db *bolt.DB) error {
 	})
 	return err
 }
+
+// createBuckets creates the buckets used by the controller if they don't
+// exist yet.
+func createBuckets(db *bolt.DB) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{[]byte("Secrets"), auditBucket} {
+			_, err := tx.CreateBucketIfNotExists(name)
+			if err != nil {
+				return fmt.Errorf("create bucket: %s", err)
+			}
+		}
+		return nil
+	})
+}
+
+// listSecretsLocal returns every secret stored locally, keyed by name.
+func listSecretsLocal(db *bolt.DB) (map[string]CustomSecretSpec, error) {
+	secrets := make(map[string]CustomSecretSpec)
+	err := db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("Secrets"))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			var secret CustomSecretSpec
+			err := gob.NewDecoder(bytes.NewReader(v)).Decode(&secret)
+			if err != nil {
+				return fmt.Errorf("decoding %s: %v", k, err)
+			}
+			registerStoredSecret(&secret)
+			secrets[string(k)] = secret
+			return nil
+		})
+	})
+	return secrets, err
+}
+
+// requestRotationLocal marks a secret stored locally so that the next sync
+// issues new credentials.
+func requestRotationLocal(name string, db *bolt.DB) error {
+	secret, err := getSecretLocal(name, db)
+	if err != nil || secret == nil {
+		return err
+	}
+
+	secret.RotateRequested = true
+	return persistSecretLocal(name, *secret, db)
+}
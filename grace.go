@@ -0,0 +1,205 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// previousKeyPrefix is prepended to the keys of the previous credentials when
+// they're published alongside the new ones
+const previousKeyPrefix = "previous-"
+
+// rotationGracePeriod returns how long the previous credentials of c are kept
+// valid after a rotation, or 0 if they aren't
+func rotationGracePeriod(c CustomSecret) time.Duration {
+	if c.Spec.RotationGracePeriod == "" {
+		return 0
+	}
+	gracePeriod, err := time.ParseDuration(c.Spec.RotationGracePeriod)
+	if err != nil || gracePeriod < 0 {
+		logWarn("Invalid rotation grace period, ignoring", customSecretFields(c).with("rotation_grace_period", c.Spec.RotationGracePeriod))
+		return 0
+	}
+	return gracePeriod
+}
+
+// startGracePeriod keeps the lease of previous, replaced by the credentials in
+// data, valid for the rotation grace period. It returns the data to write to
+// the Kubernetes secret, with the previous credentials if they're published.
+func startGracePeriod(c *CustomSecret, previous *CustomSecretSpec, data map[string]interface{}) map[string]interface{} {
+	gracePeriod := rotationGracePeriod(*c)
+	if previous == nil || previous.LeaseID == "" || gracePeriod == 0 {
+		return data
+	}
+
+	// Only one previous lease is kept
+	if c.Spec.PreviousLeaseID != "" {
+		err := revokeLease(*c, &CustomSecretSpec{LeaseID: c.Spec.PreviousLeaseID, VaultConnection: c.Spec.PreviousVaultConnection})
+		if err != nil {
+			logWarn("Error revoking previous lease", customSecretFields(*c).withLease(c.Spec.PreviousLeaseID).with("error", err))
+		}
+	}
+
+	c.Spec.PreviousLeaseID = previous.LeaseID
+	c.Spec.PreviousLeaseToken = previous.LeaseToken
+	c.Spec.PreviousVaultConnection = previous.VaultConnection
+	c.Spec.PreviousRevokeDate = time.Now().Add(gracePeriod)
+	logInfo("Keeping previous lease for the rotation grace period",
+		customSecretFields(*c).withLease(previous.LeaseID).with("revoke_at", c.Spec.PreviousRevokeDate.UTC().Format(time.RFC3339)))
+
+	if !c.Spec.PublishPrevious {
+		return data
+	}
+
+	current, err := getKubernetesSecret(c.Spec.Secret)
+	if err != nil {
+		logWarn("Error reading previous credentials, not publishing them", customSecretFields(*c).with("error", err))
+		return data
+	}
+
+	withPrevious := make(map[string]interface{}, len(data)*2)
+	for k, v := range data {
+		withPrevious[k] = v
+	}
+	for k, v := range current {
+		if !strings.HasPrefix(k, previousKeyPrefix) {
+			redactor.addValue(k, v)
+			withPrevious[previousKeyPrefix+k] = v
+		}
+	}
+	return withPrevious
+}
+
+// finishGracePeriod revokes the lease replaced by the last rotation once the
+// grace period is over, or once every pod using the secret has reloaded it.
+func finishGracePeriod(c *CustomSecret, foundSecret *CustomSecretSpec, db *bolt.DB) {
+	if foundSecret == nil || foundSecret.PreviousLeaseID == "" {
+		return
+	}
+
+	reason := ""
+	if !time.Now().Before(foundSecret.PreviousRevokeDate) {
+		reason = "grace period over"
+	} else if reloaded, err := podsReloaded(c.Spec.Secret, foundSecret.SecretVersion); err != nil {
+		logWarn("Error checking whether pods have reloaded the secret", customSecretFields(*c).with("error", err))
+	} else if reloaded {
+		reason = "all pods reloaded"
+	}
+	if reason == "" {
+		return
+	}
+
+	logInfo("Revoking previous lease", customSecretFields(*c).withLease(foundSecret.PreviousLeaseID).with("reason", reason))
+	err := revokeLease(*c, &CustomSecretSpec{LeaseID: foundSecret.PreviousLeaseID, VaultConnection: foundSecret.PreviousVaultConnection})
+	if err != nil {
+		logError("Error revoking previous lease", customSecretFields(*c).withLease(foundSecret.PreviousLeaseID).with("error", err))
+		return
+	}
+
+	current, err := getKubernetesSecret(c.Spec.Secret)
+	if err != nil {
+		logError("Error reading secret", customSecretFields(*c).with("error", err))
+		return
+	}
+	data := make(map[string]interface{}, len(current))
+	for k, v := range current {
+		if !strings.HasPrefix(k, previousKeyPrefix) {
+			data[k] = v
+		}
+	}
+	if len(data) != len(current) {
+		err = syncKubernetesSecret(c.Spec.Secret, data)
+		if err != nil {
+			failuresCounter.inc("kubernetes_sync")
+			logError("Error removing previous credentials from secret", customSecretFields(*c).with("error", err))
+			return
+		}
+	}
+
+	foundSecret.PreviousLeaseID = ""
+	foundSecret.PreviousLeaseToken = ""
+	foundSecret.PreviousVaultConnection = ""
+	foundSecret.PreviousRevokeDate = time.Time{}
+	foundSecret.SecretVersion = secretVersion(data)
+	c.Spec.PreviousLeaseID = ""
+	c.Spec.PreviousLeaseToken = ""
+	c.Spec.PreviousVaultConnection = ""
+	c.Spec.PreviousRevokeDate = time.Time{}
+	c.Spec.SecretVersion = foundSecret.SecretVersion
+	persistSecretLocal(c.Spec.Secret, *foundSecret, db)
+}
+
+// podsReloaded returns true if at least one running pod uses the secret and
+// every one of them reports having loaded the given version of it.
+func podsReloaded(secret, version string) (bool, error) {
+	if version == "" {
+		return false, nil
+	}
+
+	pods, err := getPods()
+	if err != nil {
+		return false, err
+	}
+
+	using := 0
+	for _, pod := range pods {
+		if pod.Status.Phase != "Running" || !pod.Spec.usesSecret(secret) {
+			continue
+		}
+		using++
+		if pod.Metadata.Annotations[secretAnnotation(reloadedAnnotationPrefix, secret)] != version {
+			return false, nil
+		}
+	}
+	return using > 0, nil
+}
+
+// secretVersion identifies the contents of a secret: the first 12 hex digits
+// of the SHA-256 hash of its keys and values, sorted by key, each followed by
+// a NUL byte.
+func secretVersion(data map[string]interface{}) string {
+	keys := make([]string, 0, len(data))
+	for k := range data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	h := sha256.New()
+	for _, k := range keys {
+		value, err := secretValueString(data[k])
+		if err != nil {
+			return ""
+		}
+		h.Write([]byte(k + "\x00" + value + "\x00"))
+	}
+	return hex.EncodeToString(h.Sum(nil))[:12]
+}
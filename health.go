@@ -0,0 +1,183 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var controllerHealth = &healthStatus{started: time.Now()}
+
+// healthStatus tracks the state of the controller loops that can't be
+// checked on demand.
+type healthStatus struct {
+	sync.Mutex
+	started        time.Time
+	initialSync    bool
+	lastWatch      time.Time
+	lastWatchError error
+}
+
+func (h *healthStatus) syncCompleted() {
+	h.Lock()
+	h.initialSync = true
+	h.Unlock()
+}
+
+func (h *healthStatus) watchActive() {
+	h.Lock()
+	h.lastWatch = time.Now()
+	h.lastWatchError = nil
+	h.Unlock()
+}
+
+func (h *healthStatus) watchFailed(err error) {
+	h.Lock()
+	h.lastWatchError = err
+	h.Unlock()
+}
+
+func (h *healthStatus) checkInitialSync() error {
+	h.Lock()
+	defer h.Unlock()
+	if !h.initialSync {
+		return errors.New("initial sync of CustomSecrets has not completed")
+	}
+	return nil
+}
+
+func (h *healthStatus) checkWatch() error {
+	h.Lock()
+	defer h.Unlock()
+
+	last := h.lastWatch
+	if last.IsZero() {
+		last = h.started
+	}
+	if time.Since(last) <= getWatchWindow() {
+		return nil
+	}
+	if h.lastWatchError != nil {
+		return fmt.Errorf("no watch activity for %s, last error: %v", time.Since(last), h.lastWatchError)
+	}
+	return fmt.Errorf("no watch activity for %s", time.Since(last))
+}
+
+func checkKubernetesAPI() error {
+	resp, err := kubeClient.Get(apiHost + "/version")
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return errors.New("unexpected status code: " + resp.Status)
+	}
+	return nil
+}
+
+// checkVaultTokens checks that the token of every Vault client is valid. The
+// default client is skipped when no -vault-token was given, as then only
+// VaultConnections are used.
+func checkVaultTokens() error {
+	for name, vc := range vltPool.all() {
+		if name == defaultVaultConnection && vaultToken == "" {
+			continue
+		}
+		if err := vc.lookupSelf(); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+type healthCheck struct {
+	name  string
+	check func() error
+}
+
+// livenessChecks only cover failures which restarting the controller can
+// fix; Vault being sealed is a readiness failure.
+var livenessChecks = []healthCheck{
+	{"watch", controllerHealth.checkWatch},
+}
+
+var readinessChecks = []healthCheck{
+	{"vault", checkVaultTokens},
+	{"kubernetes", checkKubernetesAPI},
+	{"initial-sync", controllerHealth.checkInitialSync},
+	{"watch", controllerHealth.checkWatch},
+}
+
+// runHealthChecks responds with 200 if all checks pass, or 503 listing the
+// checks that failed.
+func runHealthChecks(w http.ResponseWriter, checks []healthCheck) {
+	var failed []string
+	for _, c := range checks {
+		if err := c.check(); err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", c.name, err))
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if len(failed) == 0 {
+		fmt.Fprintln(w, "ok")
+		return
+	}
+
+	w.WriteHeader(http.StatusServiceUnavailable)
+	for _, f := range failed {
+		fmt.Fprintln(w, f)
+	}
+}
+
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	runHealthChecks(w, livenessChecks)
+}
+
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	runHealthChecks(w, readinessChecks)
+}
+
+// vaultHealthHandler reports the circuit breaker state of each Vault
+// connection. It responds with 503 if any breaker is open.
+func vaultHealthHandler(w http.ResponseWriter, r *http.Request) {
+	status := vltPool.breakerStatus()
+
+	code := http.StatusOK
+	for _, s := range status {
+		if s.State != breakerClosed {
+			code = http.StatusServiceUnavailable
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(status)
+}
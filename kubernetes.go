@@ -33,14 +33,16 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"os"
+	"reflect"
 	"time"
 )
 
@@ -51,7 +53,18 @@ var (
 	customSecretsEndpoint      = fmt.Sprintf("/apis/enterprises.upmc.com/v1/namespaces/%s/customsecretses", namespace)
 	customSecretsWatchEndpoint = fmt.Sprintf("/apis/enterprises.upmc.com/v1/namespaces/%s/customsecretses?watch=true", namespace)
 	secretsEndpoint            = fmt.Sprintf("/api/v1/namespaces/%s/secrets", namespace)
+	podsEndpoint               = fmt.Sprintf("/api/v1/namespaces/%s/pods", namespace)
+	deploymentsEndpoint        = fmt.Sprintf("/apis/extensions/v1beta1/namespaces/%s/deployments", namespace)
+	daemonSetsEndpoint         = fmt.Sprintf("/apis/extensions/v1beta1/namespaces/%s/daemonsets", namespace)
+	statefulSetsEndpoint       = fmt.Sprintf("/apis/apps/v1beta1/namespaces/%s/statefulsets", namespace)
+	vaultConnectionsEndpoint   = fmt.Sprintf("/apis/enterprises.upmc.com/v1/namespaces/%s/vaultconnections", namespace)
 	tprEndpoint                = "/apis/extensions/v1beta1/thirdpartyresources"
+	tokenReviewsEndpoint       = "/apis/authentication.k8s.io/v1beta1/tokenreviews"
+
+	// kubeClient is used for all requests to the Kubernetes API
+	kubeClient = &http.Client{
+		Transport: &latencyTransport{http.DefaultTransport, kubernetesLatency},
+	}
 )
 
 // ThirdPartyResource in Kubernetes
@@ -63,42 +76,375 @@ type ThirdPartyResource struct {
 	Versions    [1]map[string]string `json:"versions,omitempty"`
 }
 
+// TokenReview asks the Kubernetes API who a bearer token belongs to
+type TokenReview struct {
+	APIVersion string            `json:"apiVersion"`
+	Kind       string            `json:"kind"`
+	Spec       TokenReviewSpec   `json:"spec"`
+	Status     TokenReviewStatus `json:"status"`
+}
+
+// TokenReviewSpec holds the token to review
+type TokenReviewSpec struct {
+	Token string `json:"token"`
+}
+
+// TokenReviewStatus is the result of a TokenReview
+type TokenReviewStatus struct {
+	Authenticated bool `json:"authenticated"`
+	User          struct {
+		Username string `json:"username"`
+	} `json:"user"`
+	Error string `json:"error,omitempty"`
+}
+
 // CustomSecretEvent stores when a secret needs created
 type CustomSecretEvent struct {
 	Type   string       `json:"type"`
 	Object CustomSecret `json:"object"`
 }
 
+// ObjectMeta holds the string fields of an object's metadata, such as name
+// and namespace. Other fields, like labels, are dropped.
+type ObjectMeta map[string]string
+
+// UnmarshalJSON keeps only the string fields
+func (m *ObjectMeta) UnmarshalJSON(data []byte) error {
+	var raw map[string]interface{}
+	err := json.Unmarshal(data, &raw)
+	if err != nil {
+		return err
+	}
+
+	*m = make(ObjectMeta)
+	for k, v := range raw {
+		if s, ok := v.(string); ok {
+			(*m)[k] = s
+		}
+	}
+	return nil
+}
+
+// Annotations on a CustomSecret understood by the controller
+const (
+	// rotateAtAnnotation requests new credentials once the RFC 3339 time
+	// it's set to has passed. Each value is acted on once.
+	rotateAtAnnotation = "enterprises.upmc.com/rotate-at"
+)
+
+// reloadedAnnotationPrefix, followed by the name of a secret, is the
+// annotation pods set to the version of the secret they have loaded
+const reloadedAnnotationPrefix = "reloaded.enterprises.upmc.com/"
+
+// maxAnnotationNameLength is the longest name Kubernetes allows in an
+// annotation key, after the prefix
+const maxAnnotationNameLength = 63
+
+// secretAnnotation returns the annotation key made of prefix and the name of a
+// secret. Names too long for an annotation key are cut short and end with the
+// first 12 hex digits of the SHA-256 hash of the whole name, so they stay
+// unique.
+func secretAnnotation(prefix, secret string) string {
+	if len(secret) <= maxAnnotationNameLength {
+		return prefix + secret
+	}
+	sum := sha256.Sum256([]byte(secret))
+	hash := hex.EncodeToString(sum[:])[:12]
+	return prefix + secret[:maxAnnotationNameLength-len(hash)-1] + "-" + hash
+}
+
 // CustomSecret represents a custom secret object
 type CustomSecret struct {
-	APIVersion string            `json:"apiVersion"`
-	Kind       string            `json:"kind"`
-	Metadata   map[string]string `json:"metadata"`
-	Spec       CustomSecretSpec  `json:"spec"`
+	APIVersion  string             `json:"apiVersion"`
+	Kind        string             `json:"kind"`
+	Metadata    ObjectMeta         `json:"metadata"`
+	Annotations map[string]string  `json:"-"`
+	Spec        CustomSecretSpec   `json:"spec"`
+	Status      CustomSecretStatus `json:"status,omitempty"`
+}
+
+// UnmarshalJSON also reads the annotations from the metadata
+func (c *CustomSecret) UnmarshalJSON(data []byte) error {
+	type customSecret CustomSecret
+	err := json.Unmarshal(data, (*customSecret)(c))
+	if err != nil {
+		return err
+	}
+
+	var meta struct {
+		Metadata struct {
+			Annotations map[string]string `json:"annotations"`
+		} `json:"metadata"`
+	}
+	err = json.Unmarshal(data, &meta)
+	if err != nil {
+		return err
+	}
+	c.Annotations = meta.Metadata.Annotations
+	return nil
+}
+
+// CustomSecretStatus is written by the controller to report on a CustomSecret
+type CustomSecretStatus struct {
+	RotateAt     string `json:"rotateAt,omitempty"`
+	LastRotation string `json:"lastRotation,omitempty"`
+
+	// The TTL Vault granted the current credentials and the increment it
+	// granted their last renewal
+	TTL            string `json:"ttl,omitempty"`
+	RenewIncrement string `json:"renewIncrement,omitempty"`
 }
 
 // CustomSecretSpec represents the custom data of the object
 type CustomSecretSpec struct {
-	Policy              string    `json:"policy"`
-	Secret              string    `json:"secret"`
-	LeaseDuration       int       `json:"leaseDuration"`
-	LeaseID             string    `json:"leastId"`
-	LeaseExpirationDate time.Time `json:"leaseExpirationDate"`
+	Policy              string                 `json:"policy"`
+	Secret              string                 `json:"secret"`
+	VaultConnection     string                 `json:"vaultConnection,omitempty"`
+	Method              string                 `json:"method,omitempty"`
+	Parameters          map[string]interface{} `json:"parameters,omitempty"`
+	WrapTTL             string                 `json:"wrapTTL,omitempty"`
+	RotationSchedule    string                 `json:"rotationSchedule,omitempty"`
+	MaintenanceWindow   *MaintenanceWindowSpec `json:"maintenanceWindow,omitempty"`
+	RotationGracePeriod string                 `json:"rotationGracePeriod,omitempty"`
+	PublishPrevious     bool                   `json:"publishPrevious,omitempty"`
+	RenewalFraction     float64                `json:"renewalFraction,omitempty"`
+	RenewalJitter       float64                `json:"renewalJitter,omitempty"`
+	TTL                 string                 `json:"ttl,omitempty"`
+	RenewIncrement      string                 `json:"renewIncrement,omitempty"`
+
+	// The state kept by the controller. It's only stored locally, and never
+	// read from a CustomSecret; storedSecretSpec has it in JSON.
+	WrapExpirationDate  time.Time `json:"-"`
+	LeaseDuration       int       `json:"-"`
+	LeaseID             string    `json:"-"`
+	LeaseExpirationDate time.Time `json:"-"`
+	RenewAt             time.Time `json:"-"`
+	LastRotateAt        string    `json:"-"`
+	IssueDate           time.Time `json:"-"`
+	MaxTTL              int       `json:"-"`
+	HardExpirationDate  time.Time `json:"-"`
+	RotateRequested     bool      `json:"-"`
+	SecretVersion       string    `json:"-"`
+
+	// The Vault token the lease was issued with. Vault revokes the leases of
+	// a token along with it, so after a restart the controller still knows
+	// which replaced tokens it can revoke.
+	LeaseToken string `json:"-"`
+
+	// The lease replaced by the last rotation, kept valid during the
+	// rotation grace period
+	PreviousLeaseID         string    `json:"-"`
+	PreviousLeaseToken      string    `json:"-"`
+	PreviousVaultConnection string    `json:"-"`
+	PreviousRevokeDate      time.Time `json:"-"`
+
+	// The wrapping token replaced by the last refresh of a wrapped secret.
+	// Unless a pod has used it, it's unwrapped at PreviousRevokeDate so the
+	// lease of the credentials in it can be revoked.
+	PreviousWrapToken string `json:"-"`
+}
+
+// storedSecretSpec is the JSON form of a secret stored locally, including
+// the state the controller keeps, for the admin API and state exports. It
+// has the same fields as CustomSecretSpec, so either converts to the other.
+type storedSecretSpec struct {
+	Policy                  string                 `json:"policy"`
+	Secret                  string                 `json:"secret"`
+	VaultConnection         string                 `json:"vaultConnection,omitempty"`
+	Method                  string                 `json:"method,omitempty"`
+	Parameters              map[string]interface{} `json:"parameters,omitempty"`
+	WrapTTL                 string                 `json:"wrapTTL,omitempty"`
+	RotationSchedule        string                 `json:"rotationSchedule,omitempty"`
+	MaintenanceWindow       *MaintenanceWindowSpec `json:"maintenanceWindow,omitempty"`
+	RotationGracePeriod     string                 `json:"rotationGracePeriod,omitempty"`
+	PublishPrevious         bool                   `json:"publishPrevious,omitempty"`
+	RenewalFraction         float64                `json:"renewalFraction,omitempty"`
+	RenewalJitter           float64                `json:"renewalJitter,omitempty"`
+	TTL                     string                 `json:"ttl,omitempty"`
+	RenewIncrement          string                 `json:"renewIncrement,omitempty"`
+	WrapExpirationDate      time.Time              `json:"wrapExpirationDate"`
+	LeaseDuration           int                    `json:"leaseDuration"`
+	LeaseID                 string                 `json:"leastId"`
+	LeaseExpirationDate     time.Time              `json:"leaseExpirationDate"`
+	RenewAt                 time.Time              `json:"renewAt"`
+	LastRotateAt            string                 `json:"lastRotateAt,omitempty"`
+	IssueDate               time.Time              `json:"issueDate"`
+	MaxTTL                  int                    `json:"maxTTL,omitempty"`
+	HardExpirationDate      time.Time              `json:"hardExpirationDate"`
+	RotateRequested         bool                   `json:"rotateRequested,omitempty"`
+	SecretVersion           string                 `json:"secretVersion,omitempty"`
+	LeaseToken              string                 `json:"leaseToken,omitempty"`
+	PreviousLeaseID         string                 `json:"previousLeaseId,omitempty"`
+	PreviousLeaseToken      string                 `json:"previousLeaseToken,omitempty"`
+	PreviousVaultConnection string                 `json:"previousVaultConnection,omitempty"`
+	PreviousRevokeDate      time.Time              `json:"previousRevokeDate"`
+	PreviousWrapToken       string                 `json:"previousWrapToken,omitempty"`
+}
+
+// MaintenanceWindowSpec is when re-issuing credentials is least disruptive:
+// for Duration from each time matching the cron schedule Start
+type MaintenanceWindowSpec struct {
+	Start    string `json:"start"`
+	Duration string `json:"duration"`
 }
 
 // CustomSecretList represents a list of CustomSecrets
 type CustomSecretList struct {
+	APIVersion string         `json:"apiVersion"`
+	Kind       string         `json:"kind"`
+	Metadata   ObjectMeta     `json:"metadata"`
+	Items      []CustomSecret `json:"items"`
+}
+
+// VaultConnection represents a named Vault cluster the controller can talk to
+type VaultConnection struct {
+	APIVersion string              `json:"apiVersion"`
+	Kind       string              `json:"kind"`
+	Metadata   map[string]string   `json:"metadata"`
+	Spec       VaultConnectionSpec `json:"spec"`
+}
+
+// VaultConnectionSpec represents the address, namespace, auth and TLS
+// settings of a Vault connection
+type VaultConnectionSpec struct {
+	Address   string        `json:"address" hcl:"address"`
+	Namespace string        `json:"namespace,omitempty" hcl:"namespace"`
+	Auth      VaultAuthSpec `json:"auth" hcl:"auth"`
+	TLS       VaultTLSSpec  `json:"tls,omitempty" hcl:"tls"`
+}
+
+// VaultAuthSpec represents how the controller authenticates to Vault.
+// Credentials are read from the Kubernetes secret named by SecretName.
+type VaultAuthSpec struct {
+	Method     string `json:"method" hcl:"method"`
+	Mount      string `json:"mount,omitempty" hcl:"mount"`
+	Role       string `json:"role,omitempty" hcl:"role"`
+	SecretName string `json:"secretName,omitempty" hcl:"secret_name"`
+}
+
+// VaultTLSSpec represents the TLS settings used to connect to Vault
+type VaultTLSSpec struct {
+	CACert     string `json:"caCert,omitempty" hcl:"ca_cert"`
+	CAPath     string `json:"caPath,omitempty" hcl:"ca_path"`
+	ClientCert string `json:"clientCert,omitempty" hcl:"client_cert"`
+	ClientKey  string `json:"clientKey,omitempty" hcl:"client_key"`
+	ServerName string `json:"serverName,omitempty" hcl:"server_name"`
+	Insecure   bool   `json:"insecure,omitempty" hcl:"insecure"`
+}
+
+// VaultConnectionList represents a list of VaultConnections
+type VaultConnectionList struct {
 	APIVersion string            `json:"apiVersion"`
 	Kind       string            `json:"kind"`
-	Metadata   map[string]string `json:"metadata"`
-	Items      []CustomSecret    `json:"items"`
+	Metadata   ObjectMeta        `json:"metadata"`
+	Items      []VaultConnection `json:"items"`
+}
+
+// Pod represents the parts of a Kubernetes pod the controller looks at
+type Pod struct {
+	Metadata struct {
+		Name        string            `json:"name"`
+		Annotations map[string]string `json:"annotations"`
+	} `json:"metadata"`
+	Spec   PodSpec `json:"spec"`
+	Status struct {
+		Phase string `json:"phase"`
+	} `json:"status"`
+}
+
+// PodSpec represents where a pod gets secrets from
+type PodSpec struct {
+	Volumes []struct {
+		Secret *struct {
+			SecretName string `json:"secretName"`
+		} `json:"secret"`
+		Projected *struct {
+			Sources []struct {
+				Secret *struct {
+					Name string `json:"name"`
+				} `json:"secret"`
+			} `json:"sources"`
+		} `json:"projected"`
+	} `json:"volumes"`
+	InitContainers []Container `json:"initContainers"`
+	Containers     []Container `json:"containers"`
+}
+
+// Container represents where a container gets secrets from
+type Container struct {
+	Env []struct {
+		ValueFrom *struct {
+			SecretKeyRef *struct {
+				Name string `json:"name"`
+			} `json:"secretKeyRef"`
+		} `json:"valueFrom"`
+	} `json:"env"`
+	EnvFrom []struct {
+		SecretRef *struct {
+			Name string `json:"name"`
+		} `json:"secretRef"`
+	} `json:"envFrom"`
+}
+
+// usesSecret returns true if the pod mounts the secret, directly or in a
+// projected volume, or references it from an environment variable
+func (s PodSpec) usesSecret(name string) bool {
+	for _, v := range s.Volumes {
+		if v.Secret != nil && v.Secret.SecretName == name {
+			return true
+		}
+		if v.Projected != nil {
+			for _, source := range v.Projected.Sources {
+				if source.Secret != nil && source.Secret.Name == name {
+					return true
+				}
+			}
+		}
+	}
+	for _, c := range append(s.InitContainers, s.Containers...) {
+		for _, e := range c.Env {
+			if e.ValueFrom != nil && e.ValueFrom.SecretKeyRef != nil && e.ValueFrom.SecretKeyRef.Name == name {
+				return true
+			}
+		}
+		for _, e := range c.EnvFrom {
+			if e.SecretRef != nil && e.SecretRef.Name == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// PodList represents a list of pods
+type PodList struct {
+	Items []Pod `json:"items"`
+}
+
+// Workload represents the parts of a Deployment, StatefulSet or DaemonSet the
+// controller looks at
+type Workload struct {
+	Metadata struct {
+		Name        string            `json:"name"`
+		Annotations map[string]string `json:"annotations"`
+	} `json:"metadata"`
+	Spec struct {
+		Template struct {
+			Spec PodSpec `json:"spec"`
+		} `json:"template"`
+	} `json:"spec"`
+}
+
+// WorkloadList represents a list of Deployments, StatefulSets or DaemonSets
+type WorkloadList struct {
+	Items []Workload `json:"items"`
 }
 
 // Secret represents a Kubernetes secret type
 type Secret struct {
 	Kind       string            `json:"kind"`
 	APIVersion string            `json:"apiVersion"`
-	Metadata   map[string]string `json:"metadata"`
+	Metadata   ObjectMeta        `json:"metadata"`
 	Data       map[string]string `json:"data"`
 	Type       string            `json:"type"`
 }
@@ -107,9 +453,9 @@ func getCustomSecrets() ([]CustomSecret, error) {
 	var resp *http.Response
 	var err error
 	for {
-		resp, err = http.Get(apiHost + customSecretsEndpoint)
+		resp, err = kubeClient.Get(apiHost + customSecretsEndpoint)
 		if err != nil {
-			log.Println(err)
+			logError("Error listing CustomSecrets", logFields{"error": err})
 			time.Sleep(5 * time.Second)
 			continue
 		}
@@ -126,22 +472,94 @@ func getCustomSecrets() ([]CustomSecret, error) {
 	return customSecretList.Items, nil
 }
 
+func getVaultConnections() ([]VaultConnection, error) {
+	resp, err := kubeClient.Get(apiHost + vaultConnectionsEndpoint)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, errors.New("VaultConnections: Unexpected HTTP status code " + resp.Status)
+	}
+
+	var vaultConnectionList VaultConnectionList
+	err = json.NewDecoder(resp.Body).Decode(&vaultConnectionList)
+	if err != nil {
+		return nil, err
+	}
+
+	return vaultConnectionList.Items, nil
+}
+
+func getVaultConnection(name string) (*VaultConnection, error) {
+	resp, err := kubeClient.Get(apiHost + vaultConnectionsEndpoint + "/" + name)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("Getting %s vault connection failed: %s", name, resp.Status)
+	}
+
+	var vaultConnection VaultConnection
+	err = json.NewDecoder(resp.Body).Decode(&vaultConnection)
+	if err != nil {
+		return nil, err
+	}
+
+	return &vaultConnection, nil
+}
+
+// getKubernetesSecret returns the decoded data of a Kubernetes secret
+func getKubernetesSecret(name string) (map[string]string, error) {
+	resp, err := kubeClient.Get(apiHost + secretsEndpoint + "/" + name)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("Getting %s secret failed: %s", name, resp.Status)
+	}
+
+	var secret Secret
+	err = json.NewDecoder(resp.Body).Decode(&secret)
+	if err != nil {
+		return nil, err
+	}
+
+	data := make(map[string]string)
+	for k, v := range secret.Data {
+		value, err := base64.StdEncoding.DecodeString(v)
+		if err != nil {
+			return nil, err
+		}
+		data[k] = string(value)
+	}
+
+	return data, nil
+}
+
 func monitorCustomSecretsEvents() (<-chan CustomSecretEvent, <-chan error) {
 	events := make(chan CustomSecretEvent)
 	errc := make(chan error, 1)
 	go func() {
 		for {
-			resp, err := http.Get(apiHost + customSecretsWatchEndpoint)
+			resp, err := kubeClient.Get(apiHost + customSecretsWatchEndpoint)
 			if err != nil {
+				controllerHealth.watchFailed(err)
 				errc <- err
 				time.Sleep(5 * time.Second)
 				continue
 			}
 			if resp.StatusCode != 200 {
-				errc <- errors.New("Invalid status code: " + resp.Status)
+				resp.Body.Close()
+				err = errors.New("Invalid status code: " + resp.Status)
+				controllerHealth.watchFailed(err)
+				errc <- err
 				time.Sleep(5 * time.Second)
 				continue
 			}
+			controllerHealth.watchActive()
 
 			decoder := json.NewDecoder(resp.Body)
 			for {
@@ -151,8 +569,10 @@ func monitorCustomSecretsEvents() (<-chan CustomSecretEvent, <-chan error) {
 					errc <- err
 					break
 				}
+				controllerHealth.watchActive()
 				events <- event
 			}
+			resp.Body.Close()
 		}
 	}()
 
@@ -160,7 +580,7 @@ func monitorCustomSecretsEvents() (<-chan CustomSecretEvent, <-chan error) {
 }
 
 func checkSecret(name string) (bool, error) {
-	resp, err := http.Get(apiHost + secretsEndpoint + "/" + name)
+	resp, err := kubeClient.Get(apiHost + secretsEndpoint + "/" + name)
 	if err != nil {
 		return false, err
 	}
@@ -175,7 +595,7 @@ func deleteKubernetesSecret(domain string) error {
 	if err != nil {
 		return err
 	}
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := kubeClient.Do(req)
 	if err != nil {
 		return err
 	}
@@ -193,7 +613,11 @@ func syncKubernetesSecret(secretName string, secretData map[string]interface{})
 	// NOTE: `secretData` is from VaultSecret struct
 	data := make(map[string]string)
 	for k, v := range secretData {
-		data[k] = base64.StdEncoding.EncodeToString([]byte(v.(string)))
+		value, err := secretValueString(v)
+		if err != nil {
+			return err
+		}
+		data[k] = base64.StdEncoding.EncodeToString([]byte(value))
 	}
 
 	secret := &Secret{
@@ -204,7 +628,7 @@ func syncKubernetesSecret(secretName string, secretData map[string]interface{})
 		Type:       "Opaque",
 	}
 
-	resp, err := http.Get(apiHost + secretsEndpoint + "/" + secretName)
+	resp, err := kubeClient.Get(apiHost + secretsEndpoint + "/" + secretName)
 	if err != nil {
 		return err
 	}
@@ -222,15 +646,21 @@ func syncKubernetesSecret(secretName string, secretData map[string]interface{})
 			return err
 		}
 
-		if currentSecret.Data["username"] != secret.Data["username"] ||
-			currentSecret.Data["password"] != secret.Data["password"] {
+		if !reflect.DeepEqual(currentSecret.Data, secret.Data) {
 
-			log.Printf("%s secret out of sync.", secretName)
+			logInfo("Secret out of sync", logFields{"namespace": namespace, "secret": secretName})
 
-			currentSecret.Data = secret.Data
+			// Update the object as read, so that labels and annotations
+			// are kept
+			var rawSecret map[string]interface{}
+			err := json.Unmarshal(d, &rawSecret)
+			if err != nil {
+				return err
+			}
+			rawSecret["data"] = secret.Data
 			var b []byte
 			body := bytes.NewBuffer(b)
-			err := json.NewEncoder(body).Encode(currentSecret)
+			err = json.NewEncoder(body).Encode(rawSecret)
 			if err != nil {
 				return err
 			}
@@ -239,20 +669,21 @@ func syncKubernetesSecret(secretName string, secretData map[string]interface{})
 				return err
 			}
 			req.Header.Add("Content-Type", "application/json")
-			respSecret, err := http.DefaultClient.Do(req)
+			respSecret, err := kubeClient.Do(req)
 			if err != nil {
 				return err
 			}
-			if resp.StatusCode != 200 {
+			respSecret.Body.Close()
+			if respSecret.StatusCode != 200 {
 				return errors.New("Updating secret failed:" + respSecret.Status)
 			}
-			log.Printf("Syncing %s secret complete.", secretName)
+			logInfo("Syncing secret complete", logFields{"namespace": namespace, "secret": secretName})
 		}
 		return nil
 	}
 
 	if resp.StatusCode == 404 {
-		log.Printf("%s secret missing.", secretName)
+		logInfo("Secret missing", logFields{"namespace": namespace, "secret": secretName})
 		var b []byte
 		body := bytes.NewBuffer(b)
 		err := json.NewEncoder(body).Encode(secret)
@@ -260,21 +691,36 @@ func syncKubernetesSecret(secretName string, secretData map[string]interface{})
 			return err
 		}
 
-		resp, err := http.Post(apiHost+secretsEndpoint, "application/json", body)
+		resp, err := kubeClient.Post(apiHost+secretsEndpoint, "application/json", body)
 		if err != nil {
 			return err
 		}
 		if resp.StatusCode != 201 {
 			return errors.New("Secrets: Unexpected HTTP status code" + resp.Status)
 		}
-		log.Printf("%s secret created.", secretName)
+		logInfo("Secret created", logFields{"namespace": namespace, "secret": secretName})
 		return nil
 	}
 	return nil
 }
 
+// secretValueString converts a value from a Vault response into the string
+// stored in the Kubernetes secret. Write-style backends (e.g. PKI) return
+// numbers and lists as well as strings, so anything that isn't a string is
+// stored as JSON.
+func secretValueString(v interface{}) (string, error) {
+	if s, ok := v.(string); ok {
+		return s, nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
 // Check if CustomSecrets TPR exists. If not, create
-func createKubernetesThirdPartyResource(tpr_name string, tpr_desc string, tpr_version string) error {
+func createKubernetesThirdPartyResource(tpr_name string, tpr_desc string, tpr_version string, tpr_endpoint string) error {
 	metadata := make(map[string]string)
 	metadata["name"] = tpr_name
 
@@ -290,16 +736,16 @@ func createKubernetesThirdPartyResource(tpr_name string, tpr_desc string, tpr_ve
 		Versions:    data,
 	}
 
-	resp, _ := http.Get(apiHost + customSecretsEndpoint)
+	resp, _ := kubeClient.Get(apiHost + tpr_endpoint)
 
 	if resp.StatusCode == 200 {
 		// ThirdPartyResource already exists. Move on
-		log.Printf("ThirdPartyResource %s exists.", tpr_name)
+		logInfo("ThirdPartyResource exists", logFields{"tpr": tpr_name})
 		return nil
 	}
 
 	if resp.StatusCode == 404 {
-		log.Printf("creating ThirdPartyResource %s", tpr_name)
+		logInfo("Creating ThirdPartyResource", logFields{"tpr": tpr_name})
 		var b []byte
 		body := bytes.NewBuffer(b)
 		err := json.NewEncoder(body).Encode(tpr)
@@ -307,15 +753,149 @@ func createKubernetesThirdPartyResource(tpr_name string, tpr_desc string, tpr_ve
 			return err
 		}
 
-		resp, err := http.Post(apiHost+tprEndpoint, "application/json", body)
+		resp, err := kubeClient.Post(apiHost+tprEndpoint, "application/json", body)
 		if err != nil {
 			return err
 		}
 		if resp.StatusCode != 201 {
 			return errors.New("ThirdPartyResource: Unexpected HTTP status code" + resp.Status)
 		}
-		log.Printf("ThirdPartyResource %s created.", tpr_name)
+		logInfo("ThirdPartyResource created", logFields{"tpr": tpr_name})
 		return nil
 	}
 	return nil
 }
+
+// reviewKubernetesToken returns the user a bearer token authenticates as
+func reviewKubernetesToken(token string) (string, error) {
+	review := TokenReview{
+		APIVersion: "authentication.k8s.io/v1beta1",
+		Kind:       "TokenReview",
+		Spec:       TokenReviewSpec{Token: token},
+	}
+
+	body := new(bytes.Buffer)
+	err := json.NewEncoder(body).Encode(review)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := kubeClient.Post(apiHost+tokenReviewsEndpoint, "application/json", body)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 201 && resp.StatusCode != 200 {
+		return "", errors.New("TokenReview: Unexpected HTTP status code " + resp.Status)
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&review)
+	if err != nil {
+		return "", err
+	}
+	if !review.Status.Authenticated {
+		if review.Status.Error != "" {
+			return "", errors.New("token not authenticated: " + review.Status.Error)
+		}
+		return "", errors.New("token not authenticated")
+	}
+	return review.Status.User.Username, nil
+}
+
+// patchCustomSecretStatus merges status into the status of a CustomSecret
+func patchCustomSecretStatus(name string, status CustomSecretStatus) error {
+	body := new(bytes.Buffer)
+	err := json.NewEncoder(body).Encode(map[string]CustomSecretStatus{"status": status})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("PATCH", apiHost+customSecretsEndpoint+"/"+name, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/merge-patch+json")
+
+	resp, err := kubeClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return errors.New("CustomSecret status: Unexpected HTTP status code " + resp.Status)
+	}
+	return nil
+}
+
+// getPods lists the pods in the namespace
+func getPods() ([]Pod, error) {
+	resp, err := kubeClient.Get(apiHost + podsEndpoint)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, errors.New("Pods: Unexpected HTTP status code " + resp.Status)
+	}
+
+	var podList PodList
+	err = json.NewDecoder(resp.Body).Decode(&podList)
+	if err != nil {
+		return nil, err
+	}
+	return podList.Items, nil
+}
+
+// getWorkloads lists the Deployments, StatefulSets or DaemonSets at endpoint
+func getWorkloads(endpoint string) ([]Workload, error) {
+	resp, err := kubeClient.Get(apiHost + endpoint)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, errors.New("Workloads: Unexpected HTTP status code " + resp.Status)
+	}
+
+	var workloadList WorkloadList
+	err = json.NewDecoder(resp.Body).Decode(&workloadList)
+	if err != nil {
+		return nil, err
+	}
+	return workloadList.Items, nil
+}
+
+// patchPodTemplateAnnotation sets an annotation on the pod template of a
+// workload, which rolls out new pods
+func patchPodTemplateAnnotation(endpoint, name, key, value string) error {
+	patch := map[string]interface{}{
+		"spec": map[string]interface{}{
+			"template": map[string]interface{}{
+				"metadata": map[string]interface{}{
+					"annotations": map[string]string{key: value},
+				},
+			},
+		},
+	}
+	body := new(bytes.Buffer)
+	err := json.NewEncoder(body).Encode(patch)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("PATCH", apiHost+endpoint+"/"+name, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/merge-patch+json")
+
+	resp, err := kubeClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return errors.New("Workload: Unexpected HTTP status code " + resp.Status)
+	}
+	return nil
+}
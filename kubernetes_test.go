@@ -0,0 +1,58 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// annotationName is the syntax Kubernetes allows for the name part of an
+// annotation key
+var annotationName = regexp.MustCompile(`^[A-Za-z0-9]([-A-Za-z0-9_.]*[A-Za-z0-9])?$`)
+
+func TestSecretAnnotation(t *testing.T) {
+	if got := secretAnnotation(rolloutAnnotationPrefix, "db-credentials"); got != rolloutAnnotationPrefix+"db-credentials" {
+		t.Errorf("annotation for a short name = %q, want the name unchanged", got)
+	}
+
+	long := strings.Repeat("a", 200)
+	keys := map[string]bool{}
+	for _, secret := range []string{long + "-1", long + "-2", strings.Repeat("b.", 40) + "c"} {
+		key := secretAnnotation(reloadedAnnotationPrefix, secret)
+		name := strings.TrimPrefix(key, reloadedAnnotationPrefix)
+		if len(name) > maxAnnotationNameLength || !annotationName.MatchString(name) {
+			t.Errorf("annotation for %q = %q, want a valid key", secret, key)
+		}
+		if keys[key] {
+			t.Errorf("annotation for %q = %q, used for another secret", secret, key)
+		}
+		keys[key] = true
+		if again := secretAnnotation(reloadedAnnotationPrefix, secret); again != key {
+			t.Errorf("annotation for %q changed from %q to %q", secret, key, again)
+		}
+	}
+}
@@ -0,0 +1,304 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	levelDebug = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+// redacted replaces sensitive values in log output
+const redacted = "[REDACTED]"
+
+// maxRedactedValues bounds the number of values the redactor remembers.
+// The oldest values are forgotten first; by then their leases have long
+// been rotated.
+const maxRedactedValues = 10000
+
+// sensitiveFields are field names whose values are never logged
+var sensitiveFields = map[string]bool{
+	"token":        true,
+	"client_token": true,
+	"wrap_token":   true,
+	"password":     true,
+	"secret_id":    true,
+	"jwt":          true,
+	"lease_id":     true,
+}
+
+var logger = &structuredLogger{
+	out:   os.Stderr,
+	level: levelInfo,
+}
+
+var redactor = &secretRedactor{values: make(map[string]bool)}
+
+// logFields are the structured fields of a log line. Use customSecretFields
+// for consistent fields when logging about a CustomSecret.
+type logFields map[string]interface{}
+
+// with returns a copy of the fields with key set to value
+func (f logFields) with(key string, value interface{}) logFields {
+	fields := make(logFields, len(f)+1)
+	for k, v := range f {
+		fields[k] = v
+	}
+	fields[key] = value
+	return fields
+}
+
+// withLease adds a hash of the lease ID, which identifies the lease in logs
+// without revealing it.
+func (f logFields) withLease(leaseID string) logFields {
+	return f.with("lease_id_hash", leaseIDHash(leaseID))
+}
+
+func customSecretFields(c CustomSecret) logFields {
+	return logFields{
+		"namespace":    namespace,
+		"customsecret": c.Metadata["name"],
+		"secret":       c.Spec.Secret,
+		"vault_path":   c.Spec.Policy,
+	}
+}
+
+func leaseIDHash(leaseID string) string {
+	if leaseID == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(leaseID))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+type structuredLogger struct {
+	sync.Mutex
+	out   io.Writer
+	level int
+	json  bool
+
+	// hook, while set, receives every entry instead of out regardless of
+	// the level, e.g. to report them in a dry run
+	hook func(level int, entry map[string]string)
+}
+
+func validLogLevel(level string) bool {
+	for _, name := range levelNames {
+		if name == level {
+			return true
+		}
+	}
+	return false
+}
+
+func setLogLevel(level string) error {
+	for i, name := range levelNames {
+		if name == level {
+			logger.Lock()
+			logger.level = i
+			logger.Unlock()
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown log level: %s", level)
+}
+
+func setLogFormat(format string) error {
+	switch format {
+	case "text", "json":
+		logger.Lock()
+		logger.json = format == "json"
+		logger.Unlock()
+		return nil
+	}
+	return fmt.Errorf("unknown log format: %s", format)
+}
+
+func logDebug(msg string, fields logFields) { logger.log(levelDebug, msg, fields) }
+func logInfo(msg string, fields logFields)  { logger.log(levelInfo, msg, fields) }
+func logWarn(msg string, fields logFields)  { logger.log(levelWarn, msg, fields) }
+func logError(msg string, fields logFields) { logger.log(levelError, msg, fields) }
+
+func logFatal(msg string, fields logFields) {
+	logger.log(levelError, msg, fields)
+	os.Exit(1)
+}
+
+func (l *structuredLogger) log(level int, msg string, fields logFields) {
+	l.Lock()
+	defer l.Unlock()
+
+	if level < l.level && l.hook == nil {
+		return
+	}
+
+	entry := make(map[string]string, len(fields)+3)
+	for k, v := range fields {
+		entry[k] = redactField(k, v)
+	}
+	entry["time"] = time.Now().UTC().Format(time.RFC3339)
+	entry["level"] = levelNames[level]
+	entry["msg"] = redactor.redact(msg)
+
+	if l.hook != nil {
+		l.hook(level, entry)
+		return
+	}
+
+	if l.json {
+		json.NewEncoder(l.out).Encode(entry)
+		return
+	}
+
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	line := fmt.Sprintf("time=%s level=%s msg=%q", entry["time"], entry["level"], entry["msg"])
+	for _, k := range keys {
+		line += fmt.Sprintf(" %s=%q", k, entry[k])
+	}
+	fmt.Fprintln(l.out, line)
+}
+
+func redactField(key string, value interface{}) string {
+	if sensitiveFields[key] {
+		return redacted
+	}
+	return redactor.redact(fmt.Sprint(value))
+}
+
+// secretRedactor remembers every secret value, token and lease ID the
+// controller handles, and removes them from anything that is logged.
+type secretRedactor struct {
+	sync.Mutex
+	values map[string]bool
+	order  []string
+	// longestFirst are the values sorted by length, longest first, so a
+	// value containing another is redacted whole. Nil when out of date.
+	longestFirst []string
+}
+
+// add registers sensitive values. Very short values are ignored, since
+// redacting them would mangle unrelated output.
+func (r *secretRedactor) add(values ...string) {
+	r.Lock()
+	defer r.Unlock()
+
+	for _, v := range values {
+		if len(v) < 4 || r.values[v] {
+			continue
+		}
+		r.values[v] = true
+		r.order = append(r.order, v)
+		r.longestFirst = nil
+	}
+
+	for len(r.order) > maxRedactedValues {
+		delete(r.values, r.order[0])
+		r.order = r.order[1:]
+		r.longestFirst = nil
+	}
+}
+
+// minDataValueLength is the length from which values of secret data that
+// aren't credentials are redacted too. Shorter ones, such as ports, flags or
+// usernames, are too likely to appear in unrelated output.
+const minDataValueLength = 16
+
+// credentialKeyParts mark the keys of secret data that hold credentials
+var credentialKeyParts = []string{"password", "passwd", "secret", "token", "key", "credential", "private"}
+
+func isCredentialKey(key string) bool {
+	key = strings.ToLower(key)
+	for _, part := range credentialKeyParts {
+		if strings.Contains(key, part) {
+			return true
+		}
+	}
+	return false
+}
+
+// addData registers the string values of a Vault secret's data
+func (r *secretRedactor) addData(data map[string]interface{}) {
+	for k, v := range data {
+		if s, ok := v.(string); ok {
+			r.addValue(k, s)
+		}
+	}
+}
+
+// addValue registers the value of a key of secret data if it's a credential,
+// or long enough not to be mistaken for unrelated output
+func (r *secretRedactor) addValue(key, value string) {
+	if isCredentialKey(key) || len(value) >= minDataValueLength {
+		r.add(value)
+	}
+}
+
+func (r *secretRedactor) redact(s string) string {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.longestFirst == nil {
+		r.longestFirst = append([]string{}, r.order...)
+		sort.Slice(r.longestFirst, func(i, j int) bool {
+			return len(r.longestFirst[i]) > len(r.longestFirst[j])
+		})
+	}
+	for _, v := range r.longestFirst {
+		if strings.Contains(s, v) {
+			s = strings.Replace(s, v, redacted, -1)
+		}
+	}
+	return s
+}
+
+// stdLogWriter sends output of the standard library logger (e.g. from the
+// HTTP server) through the structured logger.
+type stdLogWriter struct{}
+
+func (stdLogWriter) Write(p []byte) (int, error) {
+	logInfo(strings.TrimSpace(string(p)), nil)
+	return len(p), nil
+}
@@ -24,8 +24,8 @@ ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
 */
 
 /*
-    Changes
-    2016-09-12: Lachlan Evenson - Add TPR creation PR 11
+   Changes
+   2016-09-12: Lachlan Evenson - Add TPR creation PR 11
 */
 
 package main
@@ -41,92 +41,240 @@ import (
 	"path"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/boltdb/bolt"
 )
 
 var (
-	dataDir          = "/var/lib/vault-manager"
-	vaultToken       = ""
-	vaultURL         = "http://127.0.0.1:8200"
-	syncIntervalSecs = 5
-	vltClient        *vaultClient
-	tpr_name 	 = "customsecrets.enterprises.upmc.com"
-	tpr_description  = "Secret which allows for secret creation of MySQL users"
-	tpr_version      = "v1"
+	dataDir            = "/var/lib/vault-manager"
+	vaultToken         = ""
+	vaultURL           = "http://127.0.0.1:8200"
+	syncIntervalSecs   = 300
+	watchWindow        = time.Hour
+	vaultTLS           VaultTLSSpec
+	listenAddr         = ":8080"
+	dryRun             = false
+	logLevel           = "info"
+	logFormat          = "text"
+	vltPool            *vaultClientPool
+	tpr_name           = "customsecrets.enterprises.upmc.com"
+	tpr_description    = "Secret which allows for secret creation of MySQL users"
+	tpr_version        = "v1"
+	vc_tpr_name        = "vault-connection.enterprises.upmc.com"
+	vc_tpr_description = "Connection settings for a Vault cluster"
 )
 
 func main() {
+	flag.StringVar(&configFile, "config", configFile, "Path to an HCL config file.")
+	flag.BoolVar(&dryRun, "dry-run", dryRun, "Print what would be done for each CustomSecret and exit, without writing to Vault or Kubernetes.")
 	flag.StringVar(&dataDir, "data-dir", dataDir, "Data directory path.")
 	flag.StringVar(&vaultToken, "vault-token", vaultToken, "Token to access vault.")
 	flag.StringVar(&vaultURL, "vault-url", vaultURL, "URL to access vault.")
-	flag.IntVar(&syncIntervalSecs, "sync-interval", syncIntervalSecs, "Sync interval in seconds.")
+	flag.StringVar(&vaultTLS.CACert, "vault-ca-cert", "", "Path to a PEM-encoded CA cert file to verify Vault with.")
+	flag.StringVar(&vaultTLS.CAPath, "vault-ca-path", "", "Path to a directory of PEM-encoded CA cert files to verify Vault with.")
+	flag.StringVar(&vaultTLS.ClientCert, "vault-client-cert", "", "Path to a PEM-encoded client certificate for Vault.")
+	flag.StringVar(&vaultTLS.ClientKey, "vault-client-key", "", "Path to the private key for the Vault client certificate.")
+	flag.StringVar(&vaultTLS.ServerName, "vault-tls-server-name", "", "Server name to use for SNI and verification when connecting to Vault.")
+	flag.BoolVar(&vaultTLS.Insecure, "vault-skip-verify", false, "Do not verify the Vault TLS certificate. Not for production use.")
+	flag.IntVar(&syncIntervalSecs, "sync-interval", syncIntervalSecs, "Interval in seconds between syncs of every CustomSecret. Leases are renewed when due regardless.")
+	flag.DurationVar(&reissueLeadTime, "reissue-lead-time", reissueLeadTime, "How long before a lease reaches its max TTL new credentials are issued.")
+	flag.Float64Var(&renewalFraction, "renewal-fraction", renewalFraction, "Default fraction of a lease's duration after which it's renewed.")
+	flag.Float64Var(&renewalJitter, "renewal-jitter", renewalJitter, "Default fraction of the renewal time by which renewals are randomly brought forward.")
+	flag.IntVar(&vaultMaxRetries, "vault-max-retries", vaultMaxRetries, "Number of times to retry Vault requests that failed for a transient reason.")
+	flag.IntVar(&vaultBreakerThreshold, "vault-breaker-threshold", vaultBreakerThreshold, "Consecutive failed Vault requests before pausing all Vault traffic.")
+	flag.DurationVar(&vaultBreakerCooldown, "vault-breaker-cooldown", vaultBreakerCooldown, "How long to pause Vault traffic before trying again.")
+	flag.DurationVar(&watchWindow, "watch-window", watchWindow, "How long the CustomSecret watch may be idle before the controller is reported unhealthy.")
+	flag.StringVar(&listenAddr, "listen-addr", listenAddr, "Address to serve health and metrics endpoints on.")
+	flag.BoolVar(&restartWorkloads, "restart-workloads", restartWorkloads, "Roll the Deployments, StatefulSets and DaemonSets using a secret after it's rotated.")
+	flag.DurationVar(&rolloutInterval, "rollout-interval", rolloutInterval, "Minimum time between restarting two workloads.")
+	flag.StringVar(&adminAddr, "admin-addr", adminAddr, "Address to serve the admin API on. Disabled if empty.")
+	flag.StringVar(&adminUsers, "admin-users", adminUsers, "Comma separated users allowed to use the admin API: Kubernetes usernames or client certificate common names.")
+	flag.StringVar(&adminTLSCert, "admin-tls-cert", adminTLSCert, "Path to a PEM-encoded certificate to serve the admin API with.")
+	flag.StringVar(&adminTLSKey, "admin-tls-key", adminTLSKey, "Path to the private key for the admin API certificate.")
+	flag.StringVar(&adminClientCA, "admin-client-ca", adminClientCA, "Path to a PEM-encoded CA cert file to verify admin API client certificates with.")
+	flag.StringVar(&adminURL, "admin-url", adminURL, "URL of a running controller's admin API, for commands.")
+	flag.StringVar(&adminToken, "admin-token", adminToken, "Bearer token to authenticate to the admin API with, for commands.")
+	flag.StringVar(&adminClientTLS.CACert, "admin-ca-cert", "", "Path to a PEM-encoded CA cert file to verify the admin API with, for commands.")
+	flag.StringVar(&adminClientTLS.ClientCert, "admin-client-cert", "", "Path to a PEM-encoded client certificate for the admin API, for commands.")
+	flag.StringVar(&adminClientTLS.ClientKey, "admin-client-key", "", "Path to the private key for the admin API client certificate, for commands.")
+	flag.StringVar(&auditSinkType, "audit-sink", auditSinkType, "Where to send audit records: stdout, file or webhook. Disabled if empty.")
+	flag.StringVar(&auditFile, "audit-file", auditFile, "File to append audit records to, for the file audit sink.")
+	flag.StringVar(&auditWebhookURL, "audit-webhook-url", auditWebhookURL, "URL to POST audit records to, for the webhook audit sink.")
+	flag.BoolVar(&agentMode, "agent", agentMode, "Run inside a pod, writing the secrets of CustomSecret manifests to a shared volume instead of Kubernetes Secrets.")
+	flag.StringVar(&agentSecrets, "agent-secrets", agentSecrets, "JSON file, or directory of .json files, of CustomSecret manifests, for agent mode.")
+	flag.StringVar(&agentOutputDir, "agent-output-dir", agentOutputDir, "Directory each secret is written to a subdirectory of, for agent mode.")
+	flag.BoolVar(&agentOnce, "agent-once", agentOnce, "Write the secrets and exit, as an init container, for agent mode.")
+	flag.StringVar(&agentAuthRole, "agent-auth-role", agentAuthRole, "Vault Kubernetes auth role to log in with the pod's service account, for agent mode.")
+	flag.StringVar(&agentAuthMount, "agent-auth-mount", agentAuthMount, "Mount of the Vault Kubernetes auth method, for agent mode.")
+	flag.StringVar(&agentSignalProcess, "agent-signal-process", agentSignalProcess, "Name of the process to signal when secrets are written, for agent mode. Requires a shared process namespace.")
+	flag.StringVar(&agentSignal, "agent-signal", agentSignal, "Signal to send to -agent-signal-process.")
+	flag.StringVar(&agentFileMode, "agent-file-mode", agentFileMode, "Octal mode of the files written in agent mode.")
+	flag.StringVar(&logLevel, "log-level", logLevel, "Log level: debug, info, warn or error.")
+	flag.StringVar(&logFormat, "log-format", logFormat, "Log format: text or json.")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] [command]\n\nFlags:\n", os.Args[0])
+		flag.PrintDefaults()
+		fmt.Fprint(os.Stderr, "\n"+commandUsage)
+	}
 	flag.Parse()
+	commandLineFlags = explicitFlags()
+
+	err := loadConfig()
+	if err != nil {
+		logFatal("Invalid configuration", logFields{"error": err})
+	}
+
+	// Send anything logged through the standard logger through redaction too
+	log.SetFlags(0)
+	log.SetOutput(stdLogWriter{})
+
+	if dryRun {
+		err = runDryRun(os.Stdout)
+		if err != nil {
+			logFatal("Dry run failed", logFields{"error": err})
+		}
+		os.Exit(0)
+	}
 
-	log.Println("Starting Kubernetes Vault Controller...")
+	if agentMode {
+		err = runAgent()
+		if err != nil {
+			logFatal("Agent failed", logFields{"error": err})
+		}
+		os.Exit(0)
+	}
+
+	if flag.NArg() > 0 {
+		err = runCommand(flag.Args())
+		if err != nil {
+			logFatal("Command failed", logFields{"command": flag.Arg(0), "error": err})
+		}
+		os.Exit(0)
+	}
+
+	logInfo("Starting Kubernetes Vault Controller...", nil)
 
 	go func() {
-		log.Println(http.ListenAndServe("127.0.0.1:6060", nil))
+		logError("pprof server stopped", logFields{"error": http.ListenAndServe("127.0.0.1:6060", nil)})
 	}()
 
 	db, err := bolt.Open(path.Join(dataDir, "data.db"), 0600, nil)
 	if err != nil {
-		log.Fatal(err)
+		logFatal("Error opening database", logFields{"error": err})
+	}
+
+	err = createBuckets(db)
+	if err != nil {
+		logFatal("Error creating database bucket", logFields{"error": err})
+	}
+
+	// Register the stored lease IDs with the redactor before anything logs
+	storedSecrets, err := listSecretsLocal(db)
+	if err != nil {
+		logWarn("Error reading stored secrets", logFields{"error": err})
 	}
 
-	err = db.Update(func(tx *bolt.Tx) error {
-		_, err = tx.CreateBucketIfNotExists([]byte("Secrets"))
+	doneChan := make(chan struct{})
+
+	if auditSinkType != "" {
+		sink, err := newAuditSink()
 		if err != nil {
-			return fmt.Errorf("create bucket: %s", err)
+			logFatal("Error creating audit sink", logFields{"error": err})
 		}
-		return nil
-	})
-	if err != nil {
-		log.Fatal(err)
+		auditLog = newAuditor(sink, db)
+		auditLog.run(doneChan)
 	}
 
+	rollouts.run(doneChan)
+
 	// Create ThirdPartyResource
-	err = createKubernetesThirdPartyResource(tpr_name, tpr_description, tpr_version)
+	err = createKubernetesThirdPartyResource(tpr_name, tpr_description, tpr_version, customSecretsEndpoint)
 	if err != nil {
-		log.Println(err)
+		logError("Error creating ThirdPartyResource", logFields{"tpr": tpr_name, "error": err})
+	}
+
+	err = createKubernetesThirdPartyResource(vc_tpr_name, vc_tpr_description, tpr_version, vaultConnectionsEndpoint)
+	if err != nil {
+		logError("Error creating ThirdPartyResource", logFields{"tpr": vc_tpr_name, "error": err})
+	}
+
+	if vaultTLS.Insecure {
+		logWarn("Vault TLS certificate verification is disabled!", nil)
 	}
 
 	// Init vault client
-	vltClient, err = newVaultClient(vaultToken, vaultURL)
+	vltClient, err := newVaultClient(vaultToken, vaultURL, vaultTLS)
 
 	if err != nil {
-		log.Println("Could not create Vault Client! ", err)
+		logError("Could not create Vault Client!", logFields{"error": err})
+	}
+
+	vltPool = newVaultClientPool(vltClient)
+	vltPool.adoptLeases(storedSecrets)
+
+	go func() {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/health/vault", vaultHealthHandler)
+		mux.HandleFunc("/metrics", metricsHandler)
+		mux.HandleFunc("/healthz", healthzHandler)
+		mux.HandleFunc("/readyz", readyzHandler)
+		logError("HTTP server stopped", logFields{"error": http.ListenAndServe(listenAddr, mux)})
+	}()
+
+	if adminAddr != "" {
+		adminServer, err := newAdminServer(db)
+		if err != nil {
+			logFatal("Error creating admin API server", logFields{"error": err})
+		}
+		go func() {
+			logError("Admin API server stopped", logFields{"error": serveAdminAPI(adminServer)})
+		}()
 	}
 
-	log.Println("Kubernetes Vault Controller started successfully.")
+	logInfo("Kubernetes Vault Controller started successfully.", nil)
 
 	// Process all Certificates definitions during the startup process.
 	err = syncCustomSecrets(db)
 	if err != nil {
-		log.Println(err)
+		logError("Error syncing CustomSecrets", logFields{"error": err})
 	}
 
-	doneChan := make(chan struct{})
 	var wg sync.WaitGroup
 
 	// Watch for events that add, modify, or delete CustomSecret definitions and
 	// process them asynchronously.
-	log.Println("Watching for custom secret events.")
+	logInfo("Watching for custom secret events.", nil)
 	wg.Add(1)
 	watchCustomSecretsEvents(db, doneChan, &wg)
 
 	// Start the custom secret reconciler that will ensure all Custom Secret
 	// definitions are implemented with a Vault secret and a Kubernetes secret.
-	log.Println("Starting reconciliation loop.")
+	logInfo("Starting reconciliation loop.", nil)
+	wg.Add(1)
+	reconcileCustomSecrets(db, doneChan, &wg)
+
+	// Process each CustomSecret again when its lease is due for renewal, or
+	// anything else about it is due.
+	logInfo("Starting lease scheduler.", nil)
 	wg.Add(1)
-	reconcileCustomSecrets(syncIntervalSecs, db, doneChan, &wg)
+	leaseSchedule.run(db, doneChan, &wg)
+
+	if configFile != "" {
+		watchConfigFile(doneChan)
+	}
 
 	signalChan := make(chan os.Signal, 1)
-	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 	for {
 		select {
-		case <-signalChan:
-			log.Printf("Shutdown signal received, exiting...")
+		case sig := <-signalChan:
+			if sig == syscall.SIGHUP {
+				logInfo("SIGHUP received, reloading config...", nil)
+				reloadConfig()
+				continue
+			}
+			logInfo("Shutdown signal received, exiting...", nil)
 			close(doneChan)
 			wg.Wait()
 			os.Exit(0)
@@ -0,0 +1,243 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A minimal Prometheus text format registry. Metric values are keyed by
+// their label values joined with labelSeparator.
+const labelSeparator = "\xff"
+
+var (
+	managedSecretsGauge = newGaugeVec("secret_manager_custom_secrets",
+		"Number of CustomSecrets managed by the controller.")
+	queueDepthGauge = newGaugeVec("secret_manager_queue_depth",
+		"Number of CustomSecrets and events waiting to be processed.")
+	operationsCounter = newCounterVec("secret_manager_operations_total",
+		"Number of successful operations on credentials.", "operation")
+	failuresCounter = newCounterVec("secret_manager_failures_total",
+		"Number of failed operations by reason.", "reason")
+	vaultLatency = newHistogram("secret_manager_vault_request_duration_seconds",
+		"Latency of requests to Vault.")
+	kubernetesLatency = newHistogram("secret_manager_kubernetes_request_duration_seconds",
+		"Latency of requests to the Kubernetes API.")
+	leaseExpiry = newLeaseExpiryGauge("secret_manager_lease_expiry_seconds",
+		"Seconds until the lease of a CustomSecret expires.")
+
+	collectors = []collector{
+		managedSecretsGauge,
+		queueDepthGauge,
+		operationsCounter,
+		failuresCounter,
+		vaultLatency,
+		kubernetesLatency,
+		leaseExpiry,
+	}
+)
+
+type collector interface {
+	write(w io.Writer)
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, c := range collectors {
+		c.write(w)
+	}
+}
+
+type metricVec struct {
+	sync.Mutex
+	name   string
+	help   string
+	kind   string
+	labels []string
+	values map[string]float64
+}
+
+func (m *metricVec) add(v float64, labelValues ...string) {
+	m.Lock()
+	m.values[strings.Join(labelValues, labelSeparator)] += v
+	m.Unlock()
+}
+
+func (m *metricVec) write(w io.Writer) {
+	m.Lock()
+	defer m.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+	keys := make([]string, 0, len(m.values))
+	for k := range m.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s%s %g\n", m.name, formatLabels(m.labels, k), m.values[k])
+	}
+}
+
+type counterVec struct {
+	metricVec
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{metricVec{name: name, help: help, kind: "counter", labels: labels, values: make(map[string]float64)}}
+}
+
+func (c *counterVec) inc(labelValues ...string) {
+	c.add(1, labelValues...)
+}
+
+type gaugeVec struct {
+	metricVec
+}
+
+func newGaugeVec(name, help string, labels ...string) *gaugeVec {
+	g := &gaugeVec{metricVec{name: name, help: help, kind: "gauge", labels: labels, values: make(map[string]float64)}}
+	if len(labels) == 0 {
+		g.values[""] = 0
+	}
+	return g
+}
+
+func (g *gaugeVec) set(v float64, labelValues ...string) {
+	g.Lock()
+	g.values[strings.Join(labelValues, labelSeparator)] = v
+	g.Unlock()
+}
+
+// leaseExpiryGauge stores the expiration date of each lease, so the number
+// of seconds left is computed when scraped.
+type leaseExpiryGauge struct {
+	sync.Mutex
+	name        string
+	help        string
+	expirations map[string]time.Time
+}
+
+func newLeaseExpiryGauge(name, help string) *leaseExpiryGauge {
+	return &leaseExpiryGauge{name: name, help: help, expirations: make(map[string]time.Time)}
+}
+
+func (g *leaseExpiryGauge) set(secret string, expiration time.Time) {
+	g.Lock()
+	g.expirations[secret] = expiration
+	g.Unlock()
+}
+
+func (g *leaseExpiryGauge) delete(secret string) {
+	g.Lock()
+	delete(g.expirations, secret)
+	g.Unlock()
+}
+
+func (g *leaseExpiryGauge) write(w io.Writer) {
+	g.Lock()
+	defer g.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", g.name, g.help, g.name)
+	secrets := make([]string, 0, len(g.expirations))
+	for s := range g.expirations {
+		secrets = append(secrets, s)
+	}
+	sort.Strings(secrets)
+	for _, s := range secrets {
+		fmt.Fprintf(w, "%s%s %g\n", g.name, formatLabels([]string{"secret"}, s),
+			g.expirations[s].Sub(time.Now()).Seconds())
+	}
+}
+
+var histogramBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type histogram struct {
+	sync.Mutex
+	name   string
+	help   string
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func newHistogram(name, help string) *histogram {
+	return &histogram{name: name, help: help, counts: make([]uint64, len(histogramBuckets))}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	v := d.Seconds()
+	h.Lock()
+	defer h.Unlock()
+	for i, b := range histogramBuckets {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+func (h *histogram) write(w io.Writer) {
+	h.Lock()
+	defer h.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	for i, b := range histogramBuckets {
+		fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", h.name, b, h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.name, h.count)
+	fmt.Fprintf(w, "%s_sum %g\n%s_count %d\n", h.name, h.sum, h.name, h.count)
+}
+
+// latencyTransport records the latency of each request in a histogram
+type latencyTransport struct {
+	transport http.RoundTripper
+	histogram *histogram
+}
+
+func (t *latencyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.transport.RoundTrip(req)
+	t.histogram.observe(time.Since(start))
+	return resp, err
+}
+
+func formatLabels(names []string, key string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	values := strings.Split(key, labelSeparator)
+	pairs := make([]string, len(names))
+	for i, n := range names {
+		pairs[i] = fmt.Sprintf("%s=%q", n, values[i])
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
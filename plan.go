@@ -0,0 +1,473 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	vaultapi "github.com/hashicorp/vault/api"
+)
+
+// customSecretPlan describes what syncCustomSecrets would do for one
+// CustomSecret. Values are never included, only key names.
+type customSecretPlan struct {
+	customSecret string
+	secret       string
+	vault        []string
+	secretAction string
+	diff         []string
+	notes        []string
+}
+
+// runDryRun prints the plan for every CustomSecret without writing to
+// Vault, Kubernetes or the local database. Each CustomSecret is processed as
+// in a sync, against a copy of the local database, while a dryRunRecorder
+// answers requests to Vault and records writes to Kubernetes.
+func runDryRun(w io.Writer) error {
+	db, cleanup, err := openDryRunDB()
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	customSecrets, err := getCustomSecrets()
+	if err != nil {
+		return err
+	}
+
+	r := &dryRunRecorder{leases: make(map[string]time.Time)}
+	restore := r.install()
+	defer restore()
+
+	var plans []customSecretPlan
+	for _, c := range customSecrets {
+		plans = append(plans, r.planCustomSecret(c, db))
+	}
+
+	restore()
+	printPlan(w, plans)
+	return nil
+}
+
+// openDryRunDB returns a copy of the local database, or an empty one if
+// there's none yet, that is removed by cleanup
+func openDryRunDB() (*bolt.DB, func(), error) {
+	dir, err := ioutil.TempDir("", "kubernetes-secret-manager-plan")
+	if err != nil {
+		return nil, nil, err
+	}
+	cleanup := func() { os.RemoveAll(dir) }
+	copyPath := filepath.Join(dir, "data.db")
+
+	local, err := bolt.Open(path.Join(dataDir, "data.db"), 0600, &bolt.Options{ReadOnly: true, Timeout: time.Second})
+	if err != nil && !os.IsNotExist(err) {
+		cleanup()
+		return nil, nil, fmt.Errorf("opening database (is the controller running?): %v", err)
+	}
+	if err != nil {
+		logWarn("No local state found, every secret would be issued", logFields{"data_dir": dataDir})
+	} else {
+		err = local.View(func(tx *bolt.Tx) error {
+			return tx.CopyFile(copyPath, 0600)
+		})
+		local.Close()
+		if err != nil {
+			cleanup()
+			return nil, nil, fmt.Errorf("copying database: %v", err)
+		}
+	}
+
+	db, err := bolt.Open(copyPath, 0600, nil)
+	if err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	if err := createBuckets(db); err != nil {
+		db.Close()
+		cleanup()
+		return nil, nil, err
+	}
+	return db, func() {
+		db.Close()
+		cleanup()
+	}, nil
+}
+
+// dryRunRecorder stands in for Vault and for writes to Kubernetes while
+// CustomSecrets are processed in a dry run, and records what would have been
+// done in the plan of the CustomSecret being processed. Reads from
+// Kubernetes go to the cluster.
+type dryRunRecorder struct {
+	plan *customSecretPlan
+	// issued is set once credentials have been requested for the plan, whose
+	// keys are only known from Vault's response
+	issued bool
+	// leases are the expiry times of the leases renewed, for lookups
+	leases map[string]time.Time
+}
+
+// install makes Vault clients and Kubernetes writes go through r, and sends
+// log entries to the plan. It returns a function undoing that.
+func (r *dryRunRecorder) install() func() {
+	pool, client, hook := vltPool, kubeClient, logger.hook
+
+	vltPool = newVaultClientPool(r.vaultClient(""))
+	vltPool.connect = func(name string, spec VaultConnectionSpec) (*pooledVaultClient, error) {
+		return &pooledVaultClient{spec: spec, client: r.vaultClient(name)}, nil
+	}
+
+	transport := client.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	kubeClient = &http.Client{Transport: &dryRunKubernetesTransport{r, transport}}
+
+	logger.Lock()
+	logger.hook = r.note
+	logger.Unlock()
+
+	restored := false
+	return func() {
+		if restored {
+			return
+		}
+		restored = true
+		vltPool, kubeClient = pool, client
+		logger.Lock()
+		logger.hook = hook
+		logger.Unlock()
+	}
+}
+
+func (r *dryRunRecorder) planCustomSecret(c CustomSecret, db *bolt.DB) customSecretPlan {
+	p := customSecretPlan{
+		customSecret: c.Metadata["name"],
+		secret:       c.Spec.Secret,
+		secretAction: "no change",
+	}
+	r.plan, r.issued = &p, false
+
+	err := updateCustomSecret(c, db)
+	if err != nil {
+		p.notes = append(p.notes, "error: "+err.Error())
+	}
+
+	r.plan = nil
+	return p
+}
+
+// noteFields are the log fields included in the notes of a plan
+var noteFields = []string{"reason", "rotate_at", "revoke_at", "lease_id_hash", "ttl_remaining", "wrap_expiration", "max_ttl_expiration", "kind", "name", "error"}
+
+// note adds what's logged about the CustomSecret being processed, and any
+// warning or error, to its plan. It's called with the logger locked.
+func (r *dryRunRecorder) note(level int, entry map[string]string) {
+	if r.plan == nil || (entry["customsecret"] == "" && level < levelWarn) {
+		return
+	}
+	var details []string
+	for _, k := range noteFields {
+		if v, ok := entry[k]; ok && v != "" {
+			details = append(details, k+"="+v)
+		}
+	}
+	note := entry["msg"]
+	if len(details) > 0 {
+		note += " (" + strings.Join(details, ", ") + ")"
+	}
+	r.plan.notes = append(r.plan.notes, note)
+}
+
+func (r *dryRunRecorder) vault(action string) {
+	if r.plan != nil {
+		r.plan.vault = append(r.plan.vault, action)
+	}
+}
+
+// vaultClient returns a client whose requests are answered by r
+func (r *dryRunRecorder) vaultClient(connection string) *vaultClient {
+	transport := &dryRunVaultTransport{r, connection}
+	config := vaultapi.DefaultConfig()
+	config.Address = "http://dry-run"
+	config.MaxRetries = 0
+	config.HttpClient = &http.Client{Transport: transport}
+	client, err := vaultapi.NewClient(config)
+	if err != nil {
+		// Only fails for an invalid address
+		panic(err)
+	}
+	client.SetToken("dry-run")
+	return &vaultClient{client: client, breaker: newCircuitBreaker(), probe: transport}
+}
+
+// dryRunVaultTransport answers requests to Vault with made up responses,
+// recording those that change anything in the plan
+type dryRunVaultTransport struct {
+	recorder   *dryRunRecorder
+	connection string
+}
+
+func (t *dryRunVaultTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	body := make(map[string]interface{})
+	if req.Body != nil {
+		decoder := json.NewDecoder(req.Body)
+		decoder.UseNumber()
+		decoder.Decode(&body)
+		req.Body.Close()
+	}
+	leaseID, _ := body["lease_id"].(string)
+	vaultPath := strings.TrimPrefix(req.URL.Path, "/v1/")
+	on := ""
+	if t.connection != "" {
+		on = " on " + t.connection
+	}
+
+	switch {
+	case strings.HasPrefix(vaultPath, "auth/"):
+		return dryRunResponse(req, http.StatusOK, map[string]interface{}{
+			"auth": map[string]interface{}{"client_token": "dry-run"},
+			"data": map[string]interface{}{},
+		})
+	case vaultPath == "sys/renew":
+		increment := dryRunSeconds(fmt.Sprint(body["increment"]))
+		t.recorder.vault("renew lease " + leaseIDHash(leaseID))
+		t.recorder.leases[leaseID] = time.Now().Add(time.Duration(increment) * time.Second)
+		return dryRunResponse(req, http.StatusOK, map[string]interface{}{
+			"lease_id":       leaseID,
+			"lease_duration": increment,
+			"renewable":      true,
+		})
+	case strings.HasPrefix(vaultPath, "sys/revoke/"):
+		t.recorder.vault("revoke lease " + leaseIDHash(strings.TrimPrefix(vaultPath, "sys/revoke/")))
+		return dryRunResponse(req, http.StatusNoContent, nil)
+	case vaultPath == "sys/leases/lookup":
+		expires, ok := t.recorder.leases[leaseID]
+		if !ok {
+			return dryRunResponse(req, http.StatusBadRequest, map[string]interface{}{
+				"errors": []string{"leases aren't looked up in a dry run"},
+			})
+		}
+		return dryRunResponse(req, http.StatusOK, map[string]interface{}{
+			"data": map[string]interface{}{"id": leaseID, "expire_time": expires.Format(time.RFC3339Nano)},
+		})
+	case vaultPath == "sys/wrapping/unwrap":
+		t.recorder.vault("unwrap the replaced wrapping token and revoke the lease in it")
+		return dryRunResponse(req, http.StatusOK, map[string]interface{}{"data": map[string]interface{}{}})
+	case req.Header.Get("X-Vault-Wrap-TTL") != "":
+		wrapTTL := req.Header.Get("X-Vault-Wrap-TTL")
+		t.recorder.vault(req.Method + " " + vaultPath + on + " (wrapped, ttl " + wrapTTL + ")")
+		return dryRunResponse(req, http.StatusOK, map[string]interface{}{
+			"wrap_info": map[string]interface{}{"token": "dry-run", "ttl": dryRunSeconds(wrapTTL)},
+		})
+	}
+
+	t.recorder.vault(req.Method + " " + vaultPath + on)
+	t.recorder.issued = true
+	ttl := req.URL.Query().Get("ttl")
+	if v, ok := body["ttl"]; ok {
+		ttl = fmt.Sprint(v)
+	}
+	return dryRunResponse(req, http.StatusOK, map[string]interface{}{
+		"lease_id":       vaultPath + "/dry-run",
+		"lease_duration": dryRunSeconds(ttl),
+		"renewable":      true,
+		"data":           map[string]interface{}{},
+	})
+}
+
+// dryRunSeconds parses a TTL as Vault does: a number of seconds or a
+// duration. Anything else is 0.
+func dryRunSeconds(ttl string) int {
+	if n, err := strconv.Atoi(ttl); err == nil {
+		return n
+	}
+	d, _ := time.ParseDuration(ttl)
+	return int(d.Seconds())
+}
+
+func dryRunResponse(req *http.Request, status int, body interface{}) (*http.Response, error) {
+	var b bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&b).Encode(body); err != nil {
+			return nil, err
+		}
+	}
+	return &http.Response{
+		Status:     strconv.Itoa(status) + " " + http.StatusText(status),
+		StatusCode: status,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       ioutil.NopCloser(&b),
+		Request:    req,
+	}, nil
+}
+
+// dryRunKubernetesTransport sends reads to the cluster and records writes
+// in the plan instead
+type dryRunKubernetesTransport struct {
+	recorder  *dryRunRecorder
+	transport http.RoundTripper
+}
+
+func (t *dryRunKubernetesTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method == "GET" {
+		return t.transport.RoundTrip(req)
+	}
+
+	var body []byte
+	if req.Body != nil {
+		body, _ = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+	}
+	p := t.recorder.plan
+	status := http.StatusOK
+	if req.Method == "POST" {
+		status = http.StatusCreated
+	}
+
+	switch {
+	case p == nil:
+	case strings.HasPrefix(req.URL.Path, secretsEndpoint) && req.Method == "DELETE":
+		p.secretAction = "delete"
+	case strings.HasPrefix(req.URL.Path, secretsEndpoint):
+		var secret Secret
+		json.Unmarshal(body, &secret)
+		keys := []string{}
+		for k := range secret.Data {
+			keys = append(keys, k)
+		}
+		if t.recorder.issued {
+			// The keys are those in Vault's response
+			keys = nil
+		}
+		p.diff = nil
+		planSecretWrite(p, keys)
+	case strings.HasPrefix(req.URL.Path, customSecretsEndpoint):
+		p.notes = append(p.notes, "update the CustomSecret status")
+	default:
+		p.notes = append(p.notes, req.Method+" "+req.URL.Path)
+	}
+
+	resp, err := dryRunResponse(req, status, nil)
+	if err == nil {
+		resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	return resp, err
+}
+
+// planSecretWrite fills in how the Kubernetes secret would change. newKeys
+// is nil when the keys depend on the Vault response.
+func planSecretWrite(p *customSecretPlan, newKeys []string) {
+	exists, err := checkSecret(p.secret)
+	if err != nil {
+		p.notes = append(p.notes, "error checking secret: "+err.Error())
+		return
+	}
+
+	if !exists {
+		p.secretAction = "create"
+		for _, k := range newKeys {
+			p.diff = append(p.diff, "+ "+k)
+		}
+		return
+	}
+
+	p.secretAction = "update"
+	current, err := getKubernetesSecret(p.secret)
+	if err != nil {
+		p.notes = append(p.notes, "error reading secret: "+err.Error())
+		return
+	}
+
+	if newKeys == nil {
+		for k := range current {
+			p.diff = append(p.diff, "~ "+k)
+		}
+		sort.Strings(p.diff)
+		p.notes = append(p.notes, "keys are replaced with those in the Vault response")
+		return
+	}
+
+	wanted := make(map[string]bool)
+	for _, k := range newKeys {
+		wanted[k] = true
+		if _, ok := current[k]; ok {
+			p.diff = append(p.diff, "~ "+k)
+		} else {
+			p.diff = append(p.diff, "+ "+k)
+		}
+	}
+	for k := range current {
+		if !wanted[k] {
+			p.diff = append(p.diff, "- "+k)
+		}
+	}
+	sort.Strings(p.diff)
+}
+
+func printPlan(w io.Writer, plans []customSecretPlan) {
+	changes := 0
+	for _, p := range plans {
+		if len(p.vault) == 0 && p.secretAction == "no change" {
+			continue
+		}
+		changes++
+	}
+
+	for _, p := range plans {
+		fmt.Fprintf(w, "CustomSecret %s (secret %s)\n", p.customSecret, p.secret)
+		if len(p.vault) == 0 {
+			fmt.Fprintln(w, "  vault:  no change")
+		}
+		for _, v := range p.vault {
+			fmt.Fprintf(w, "  vault:  %s\n", v)
+		}
+		fmt.Fprintf(w, "  secret: %s\n", p.secretAction)
+		for _, d := range p.diff {
+			fmt.Fprintf(w, "    %s (value redacted)\n", d)
+		}
+		for _, n := range p.notes {
+			fmt.Fprintf(w, "  note:   %s\n", n)
+		}
+		fmt.Fprintln(w)
+	}
+
+	fmt.Fprintf(w, "Plan: %d of %d CustomSecrets would change.\n", changes, len(plans))
+	if len(plans) > 0 && changes == 0 {
+		fmt.Fprintln(w, "Nothing to do.")
+	}
+}
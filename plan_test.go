@@ -0,0 +1,145 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+func TestDryRun(t *testing.T) {
+	captureLogs(t)
+	dir, err := ioutil.TempDir("", "kubernetes-secret-manager")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	previousDataDir := dataDir
+	dataDir = dir
+	t.Cleanup(func() { dataDir = previousDataDir })
+
+	now := time.Now()
+	stored := map[string]CustomSecretSpec{
+		"renew-due": {
+			Secret: "renew-due", Policy: "database/creds/renew-due", LeaseID: "database/creds/renew-due/1",
+			LeaseDuration: 3600, LeaseExpirationDate: now.Add(10 * time.Minute), RenewAt: now.Add(-time.Minute), IssueDate: now.Add(-time.Hour),
+		},
+		"valid": {
+			Secret: "valid", Policy: "database/creds/valid", LeaseID: "database/creds/valid/1",
+			LeaseDuration: 3600, LeaseExpirationDate: now.Add(2 * time.Hour), RenewAt: now.Add(time.Hour), IssueDate: now,
+		},
+		"wrapped": {
+			Secret: "wrapped", Policy: "secret/wrapped", WrapTTL: "1h",
+			WrapExpirationDate: now.Add(time.Hour), RenewAt: now.Add(30 * time.Minute), IssueDate: now,
+		},
+	}
+	db, err := bolt.Open(filepath.Join(dir, "data.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := createBuckets(db); err != nil {
+		t.Fatal(err)
+	}
+	for name, spec := range stored {
+		if err := persistSecretLocal(name, spec, db); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+
+	var customSecrets CustomSecretList
+	for _, name := range []string{"new", "renew-due", "valid", "wrapped"} {
+		spec := stored[name]
+		spec.Secret, spec.Policy = name, "database/creds/"+name
+		if name == "wrapped" {
+			spec.Policy = "secret/wrapped"
+		}
+		customSecrets.Items = append(customSecrets.Items, CustomSecret{Metadata: ObjectMeta{"name": name}, Spec: spec})
+	}
+	useKubernetesAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method != "GET":
+			t.Errorf("dry run sent %s %s", r.Method, r.URL.Path)
+		case r.URL.Path == customSecretsEndpoint:
+			json.NewEncoder(w).Encode(customSecrets)
+			return
+		case strings.HasPrefix(r.URL.Path, secretsEndpoint+"/") && r.URL.Path != secretsEndpoint+"/new":
+			json.NewEncoder(w).Encode(Secret{Data: map[string]string{"username": "dXNlcg==", "password": "cGFzcw=="}})
+			return
+		}
+		http.NotFound(w, r)
+	})
+
+	var out bytes.Buffer
+	if err := runDryRun(&out); err != nil {
+		t.Fatal(err)
+	}
+	plan := out.String()
+	for _, want := range []string{
+		"CustomSecret new (secret new)\n  vault:  GET database/creds/new\n  secret: create\n",
+		"CustomSecret renew-due (secret renew-due)\n  vault:  renew lease " + leaseIDHash("database/creds/renew-due/1") + "\n  secret: no change\n",
+		"note:   Renewing lease",
+		"note:   update the CustomSecret status",
+		"CustomSecret valid (secret valid)\n  vault:  no change\n  secret: no change\n",
+		"note:   Lease is valid, skipping renewal",
+		"CustomSecret wrapped (secret wrapped)\n  vault:  no change\n  secret: no change\n",
+		"note:   Wrapping token is valid, skipping refresh",
+		"Plan: 2 of 4 CustomSecrets would change.",
+	} {
+		if !strings.Contains(plan, want) {
+			t.Errorf("plan doesn't contain %q:\n%s", want, plan)
+		}
+	}
+
+	// The local database is left as it was
+	db, err = bolt.Open(filepath.Join(dir, "data.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	secrets, err := listSecretsLocal(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(secrets) != len(stored) {
+		t.Errorf("dry run stored %d secrets, want %d", len(secrets), len(stored))
+	}
+	for name, spec := range stored {
+		got := secrets[name]
+		if !got.LeaseExpirationDate.Equal(spec.LeaseExpirationDate) || !reflect.DeepEqual(got.RenewAt.Unix(), spec.RenewAt.Unix()) {
+			t.Errorf("dry run changed stored secret %s: %+v", name, got)
+		}
+	}
+}
@@ -31,30 +31,32 @@ package main
 
 import (
 	"errors"
-	"log"
+	"fmt"
 	"math"
+	"strconv"
 	"sync"
 	"time"
 
 	"github.com/boltdb/bolt"
+	vaultapi "github.com/hashicorp/vault/api"
 )
 
 // processorLock ensures that reconciliation and event processing does
 // not happen at the same time.
 var processorLock = &sync.Mutex{}
 
-func reconcileCustomSecrets(interval int, db *bolt.DB, done chan struct{}, wg *sync.WaitGroup) {
+func reconcileCustomSecrets(db *bolt.DB, done chan struct{}, wg *sync.WaitGroup) {
 	go func() {
 		for {
 			select {
-			case <-time.After(time.Duration(interval) * time.Second):
+			case <-time.After(getSyncInterval()):
 				err := syncCustomSecrets(db)
 				if err != nil {
-					log.Println(err)
+					logError("Error syncing CustomSecrets", logFields{"error": err})
 				}
 			case <-done:
 				wg.Done()
-				log.Println("Stopped reconciliation loop.")
+				logInfo("Stopped reconciliation loop", nil)
 				return
 			}
 		}
@@ -67,15 +69,18 @@ func watchCustomSecretsEvents(db *bolt.DB, done chan struct{}, wg *sync.WaitGrou
 		for {
 			select {
 			case event := <-events:
+				id := workQueue.add(event.Object, "event "+event.Type)
 				err := processCustomSecretEvent(event, db)
+				workQueue.done(id)
 				if err != nil {
-					log.Println(err)
+					logError("Error processing CustomSecret event",
+						customSecretFields(event.Object).with("event", event.Type).with("error", err))
 				}
 			case err := <-watchErrs:
-				log.Println(err)
+				logWarn("CustomSecret watch error", logFields{"error": err})
 			case <-done:
 				wg.Done()
-				log.Println("Stopped custom secrets event watcher.")
+				logInfo("Stopped custom secrets event watcher", nil)
 				return
 			}
 		}
@@ -91,18 +96,35 @@ func syncCustomSecrets(db *bolt.DB) error {
 		return err
 	}
 
+	vaultConnections, err := getVaultConnections()
+	if err != nil {
+		logWarn("Error listing VaultConnections", logFields{"error": err})
+	} else {
+		vltPool.refresh(append(vaultConnections, getFileVaultConnections()...))
+	}
+
+	managedSecretsGauge.set(float64(len(customSecrets)))
+
 	var wg sync.WaitGroup
 	for _, secret := range customSecrets {
+		if pausedNamespaces.isPaused(customSecretNamespace(secret)) {
+			logDebug("Reconciliation paused, skipping CustomSecret", customSecretFields(secret))
+			continue
+		}
+
 		wg.Add(1)
+		id := workQueue.add(secret, "sync")
 		go func(secret CustomSecret) {
 			defer wg.Done()
+			defer workQueue.done(id)
 			err := processCustomSecret(secret, db)
 			if err != nil {
-				log.Println(err)
+				logError("Error processing CustomSecret", customSecretFields(secret).with("error", err))
 			}
 		}(secret)
 	}
 	wg.Wait()
+	controllerHealth.syncCompleted()
 	return nil
 }
 
@@ -110,7 +132,11 @@ func processCustomSecretEvent(c CustomSecretEvent, db *bolt.DB) error {
 	processorLock.Lock()
 	defer processorLock.Unlock()
 	switch {
-	case c.Type == "ADDED":
+	case c.Type == "ADDED" || c.Type == "MODIFIED":
+		if pausedNamespaces.isPaused(customSecretNamespace(c.Object)) {
+			logInfo("Reconciliation paused, skipping CustomSecret", customSecretFields(c.Object))
+			return nil
+		}
 		return processCustomSecret(c.Object, db)
 	case c.Type == "DELETED":
 		return deleteCustomSecret(c.Object, db)
@@ -120,76 +146,580 @@ func processCustomSecretEvent(c CustomSecretEvent, db *bolt.DB) error {
 
 func deleteCustomSecret(c CustomSecret, db *bolt.DB) error {
 	deleteSecretLocal(c.Spec.Secret, db)
-	log.Printf("Deleting Kubernetes CustomSecret secret: %s", c.Spec.Secret)
+	leaseExpiry.delete(c.Spec.Secret)
+	leaseSchedule.remove(c.Spec.Secret)
+	logInfo("Deleting Kubernetes CustomSecret secret", customSecretFields(c))
 	return deleteKubernetesSecret(c.Spec.Secret)
 }
 
+// Lease actions decided by nextLeaseAction
+const (
+	leaseIssue   = "issue"
+	leaseReissue = "reissue"
+	leaseRenew   = "renew"
+	leaseValid   = "valid"
+)
+
+// nextLeaseAction decides what to do with the lease of a secret stored
+// locally: issue if there's none, re-issue once expired, renew once its
+// renewal time has passed, otherwise nothing. Leases stored without a renewal
+// time are renewed once less than half of the lease duration is left.
+func nextLeaseAction(foundSecret *CustomSecretSpec) string {
+	if foundSecret == nil {
+		return leaseIssue
+	}
+
+	// Lookup the duration left on the lease, if expiring soon then renew
+	ttlRemaining := foundSecret.LeaseExpirationDate.Sub(time.Now())
+
+	// If the expiration date is in the past
+	if ttlRemaining.Seconds() <= 0 {
+		return leaseReissue
+	}
+
+	// A lease that has been renewed up to its max TTL can't be renewed any
+	// further; it's re-issued before then instead
+	if hardExpiry := hardExpiration(foundSecret); !hardExpiry.IsZero() && !foundSecret.LeaseExpirationDate.Before(hardExpiry.Add(-leaseCapTolerance)) {
+		return leaseValid
+	}
+
+	if !foundSecret.RenewAt.IsZero() {
+		if time.Now().Before(foundSecret.RenewAt) {
+			return leaseValid
+		}
+		return leaseRenew
+	}
+
+	// If ttl remaining is less than 1/2 of ttl lease, renew
+	if int(math.Abs(ttlRemaining.Seconds())) <= foundSecret.LeaseDuration/2 {
+		return leaseRenew
+	}
+
+	return leaseValid
+}
+
+// wrapValid returns true while the wrapping token of a secret stored locally
+// isn't due to be replaced. Like a lease, it's replaced once the renewal
+// fraction of its TTL has passed, so the Secret never holds an expired token.
+func wrapValid(foundSecret *CustomSecretSpec) bool {
+	if foundSecret == nil {
+		return false
+	}
+	if !foundSecret.RenewAt.IsZero() && !time.Now().Before(foundSecret.RenewAt) {
+		return false
+	}
+	return time.Now().Before(foundSecret.WrapExpirationDate)
+}
+
+// processCustomSecret brings the secret of c up to date, then schedules when
+// it next needs processing.
 func processCustomSecret(c CustomSecret, db *bolt.DB) error {
+	err := updateCustomSecret(c, db)
+	scheduleCustomSecret(c, db, err != nil)
+	return err
+}
+
+func updateCustomSecret(c CustomSecret, db *bolt.DB) error {
+	if c.Spec.WrapTTL != "" {
+		return processWrappedCustomSecret(c, db)
+	}
 
 	//See if existing already
 	foundSecret, _ := getSecretLocal(c.Spec.Secret, db)
+	rotation := false
 
-	if foundSecret != nil {
-
-		// Lookup the duration left on the lease, if expiring soon then renew
-		ttlRemaining := foundSecret.LeaseExpirationDate.Sub(time.Now())
+	seedIssueDate(c, foundSecret, db)
+	carryLocalState(&c.Spec, foundSecret)
+	finishGracePeriod(&c, foundSecret, db)
 
-		// If the expiration date is in the past
-		if ttlRemaining.Seconds() <= 0 {
-			// Refresh creds
-			deleteSecretLocal(c.Spec.Secret, db)
-		} else if int(math.Abs(ttlRemaining.Seconds())) <= foundSecret.LeaseDuration/2 {
-			// If ttl remaining is less than 1/2 of ttl lease, renew
-			log.Println("Renewing lease for id: ", foundSecret.LeaseID)
-			renewedSecret, err := vltClient.renewVaultLease(foundSecret.LeaseID, foundSecret.LeaseDuration)
+	// The lease being replaced, if it's still valid. The secret stored
+	// locally is kept until new credentials have been written, so a failure
+	// leaves the current ones in place to be replaced on the next attempt.
+	var previous *CustomSecretSpec
 
+	action := nextLeaseAction(foundSecret)
+	rotateAt, rotationDue := rotationRequested(c, foundSecret)
+	if rotationDue {
+		// The credentials may have leaked, so they're revoked straight away
+		// regardless of the rotation grace period
+		c.Spec.LastRotateAt = rotateAt
+		if foundSecret != nil {
+			logInfo("Rotation requested", customSecretFields(c).with("rotate_at", rotateAt))
+			err := revokeLease(c, foundSecret)
 			if err != nil {
-				return errors.New("[Processor] Error renewing lease from Vault: " + err.Error())
+				return err
 			}
+			rotation = true
+		}
+		action = leaseIssue
+	} else if foundSecret != nil && foundSecret.RotateRequested {
+		logInfo("Re-issuing credentials", customSecretFields(c).withLease(foundSecret.LeaseID).with("reason", "rotation requested"))
+		previous = foundSecret
+		rotation = true
+		action = leaseIssue
+	} else if reason, due := scheduledReissue(c, foundSecret); due {
+		logInfo("Re-issuing credentials", customSecretFields(c).withLease(foundSecret.LeaseID).with("reason", reason))
+		previous = foundSecret
+		rotation = true
+		action = leaseIssue
+	}
 
-			// If secret is hitting max ttl, refresh with new secret from Vault
-			if renewedSecret.LeaseDuration < foundSecret.LeaseDuration {
-				deleteSecretLocal(c.Spec.Secret, db)
-			} else {
+	switch action {
+	case leaseReissue:
+		// Refresh creds
+		rotation = true
+	case leaseRenew:
+		return renewLease(c, foundSecret, db)
+	case leaseValid:
+		ttlRemaining := foundSecret.LeaseExpirationDate.Sub(time.Now())
+		logDebug("Lease is valid, skipping renewal",
+			customSecretFields(c).withLease(foundSecret.LeaseID).with("ttl_remaining", math.Abs(ttlRemaining.Seconds())))
+		leaseExpiry.set(c.Spec.Secret, foundSecret.LeaseExpirationDate)
 
-				// Update DB
-				c.Spec.LeaseID = renewedSecret.LeaseID
-				c.Spec.LeaseDuration = renewedSecret.LeaseDuration
-				c.Spec.LeaseExpirationDate = time.Now().Add(time.Second * time.Duration(renewedSecret.LeaseDuration))
-				persistSecretLocal(c.Spec.Secret, c.Spec, db)
+		return nil
+	}
 
-				return nil
-			}
-		} else {
-			log.Printf("Lease (%s) is valid, skipping renewal! TTL remaining: %f",
-				foundSecret.LeaseID, math.Abs(ttlRemaining.Seconds()))
+	vc, err := vltPool.get(c.Spec.VaultConnection)
+	if err != nil {
+		return errors.New("[Processor] Error getting Vault client: " + err.Error())
+	}
 
-			return nil
+	// Request credentials from user
+	secret, err := issueLease(&c, vc)
+	if err != nil {
+		return err
+	}
+
+	data := startGracePeriod(&c, previous, secret.Data)
+	c.Spec.SecretVersion = secretVersion(data)
+
+	err = syncKubernetesSecret(c.Spec.Secret, data)
+
+	if err != nil {
+		failuresCounter.inc("kubernetes_sync")
+
+		// Delete the Vault secret since we couldn't persist to k8s
+		revokeErr := vc.revokeVaultSecret(secret.LeaseID)
+		if revokeErr != nil {
+			failuresCounter.inc("vault_revoke")
+		} else {
+			operationsCounter.inc("revoke")
 		}
+		auditCustomSecret("revoke", c, secret.LeaseID, secret.Data, revokeErr)
+
+		return errors.New("[Processor] Error creating Kubernetes secret: " + err.Error())
 	}
 
-	// Request credentials from user
-	secret, err := vltClient.readVaultSecret(c.Spec.Policy)
+	// Persist to DB
+	persistSecretLocal(c.Spec.Secret, c.Spec, db)
+
+	operationsCounter.inc("issue")
+	if rotation {
+		operationsCounter.inc("rotate")
+		auditCustomSecret("rotate", c, secret.LeaseID, secret.Data, nil)
+		queueRollouts(c)
+	}
+	leaseExpiry.set(c.Spec.Secret, c.Spec.LeaseExpirationDate)
+	updateLeaseStatus(c, c.Spec.LeaseDuration, 0)
+
+	if rotation || rotationDue {
+		updateRotationStatus(c, rotateAt)
+	}
 
+	return nil
+}
+
+// carryLocalState copies what the controller keeps about a secret, rather
+// than reads from the CustomSecret, from the secret stored locally.
+func carryLocalState(spec *CustomSecretSpec, foundSecret *CustomSecretSpec) {
+	if foundSecret == nil {
+		return
+	}
+	spec.LastRotateAt = foundSecret.LastRotateAt
+	spec.IssueDate = foundSecret.IssueDate
+	spec.MaxTTL = foundSecret.MaxTTL
+	spec.HardExpirationDate = foundSecret.HardExpirationDate
+	spec.RenewAt = foundSecret.RenewAt
+	spec.SecretVersion = foundSecret.SecretVersion
+	spec.LeaseToken = foundSecret.LeaseToken
+	spec.PreviousLeaseID = foundSecret.PreviousLeaseID
+	spec.PreviousLeaseToken = foundSecret.PreviousLeaseToken
+	spec.PreviousVaultConnection = foundSecret.PreviousVaultConnection
+	spec.PreviousRevokeDate = foundSecret.PreviousRevokeDate
+	spec.PreviousWrapToken = foundSecret.PreviousWrapToken
+}
+
+// rotationRequested returns the value of the rotate-at annotation of c if its
+// time has passed and it hasn't been acted on yet.
+func rotationRequested(c CustomSecret, foundSecret *CustomSecretSpec) (string, bool) {
+	rotateAt := c.Annotations[rotateAtAnnotation]
+	if rotateAt == "" || rotateAt == c.Status.RotateAt {
+		return "", false
+	}
+	if foundSecret != nil && foundSecret.LastRotateAt == rotateAt {
+		return "", false
+	}
+
+	t, err := time.Parse(time.RFC3339, rotateAt)
 	if err != nil {
-		return errors.New("[Processor] Error getting secret from Vault: " + err.Error())
+		logWarn("Invalid rotate-at annotation, ignoring", customSecretFields(c).with("rotate_at", rotateAt).with("error", err))
+		return "", false
+	}
+	return rotateAt, !time.Now().Before(t)
+}
+
+// updateRotationStatus records a completed rotation in the status of c, along
+// with the rotate-at annotation value it was for, if any.
+func updateRotationStatus(c CustomSecret, rotateAt string) {
+	status := CustomSecretStatus{
+		RotateAt:     rotateAt,
+		LastRotation: time.Now().UTC().Format(time.RFC3339),
+	}
+	err := patchCustomSecretStatus(c.Metadata["name"], status)
+	if err != nil {
+		logWarn("Error updating CustomSecret status", customSecretFields(c).with("error", err))
+	}
+}
+
+// renewLease renews the lease of a secret stored locally with the connection
+// that issued it. If Vault caps the renewal, the lease has reached its max
+// TTL: the shortened lease is kept, and new credentials are issued before it
+// expires.
+func renewLease(c CustomSecret, foundSecret *CustomSecretSpec, db *bolt.DB) error {
+	logInfo("Renewing lease", customSecretFields(c).withLease(foundSecret.LeaseID))
+
+	vc, err := vltPool.get(foundSecret.VaultConnection)
+	if err != nil {
+		return errors.New("[Processor] Error getting Vault client: " + err.Error())
+	}
+
+	carryLocalState(&c.Spec, foundSecret)
+	granted, err := extendLease(&c, vc, foundSecret)
+	if err != nil {
+		return err
+	}
+
+	// Update DB
+	persistSecretLocal(c.Spec.Secret, c.Spec, db)
+	leaseExpiry.set(c.Spec.Secret, c.Spec.LeaseExpirationDate)
+	updateLeaseStatus(c, 0, granted)
+
+	return nil
+}
+
+// issueLease requests new credentials for c from Vault and records their
+// lease in c.
+func issueLease(c *CustomSecret, vc *vaultClient) (*vaultapi.Secret, error) {
+	ttl := leaseTTL(*c)
+	secret, err := vc.requestVaultSecret(c.Spec, ttl)
+
+	if err != nil {
+		failuresCounter.inc("vault_issue")
+		auditCustomSecret("issue", *c, "", nil, err)
+		return nil, errors.New("[Processor] Error getting secret from Vault: " + err.Error())
+	}
+
+	// Not every secrets engine takes a ttl parameter, so a longer lease is
+	// shortened by renewing it
+	if ttl > 0 && secret.Renewable && secret.LeaseDuration > ttl {
+		shortened, err := vc.renewVaultLease(secret.LeaseID, ttl)
+		if err != nil {
+			failuresCounter.inc("vault_renew")
+			logWarn("Error shortening lease to the requested TTL", customSecretFields(*c).withLease(secret.LeaseID).with("error", err))
+		} else {
+			secret.LeaseDuration = shortened.LeaseDuration
+		}
 	}
 
 	c.Spec.LeaseDuration = secret.LeaseDuration
 	c.Spec.LeaseID = secret.LeaseID
+	c.Spec.LeaseToken = vc.client.Token()
 	c.Spec.LeaseExpirationDate = time.Now().Add(time.Second * time.Duration(secret.LeaseDuration))
+	c.Spec.RenewAt = renewalTime(*c, secret.LeaseDuration)
+	c.Spec.IssueDate = time.Now()
+	c.Spec.HardExpirationDate = time.Time{}
+	auditCustomSecret("issue", *c, secret.LeaseID, secret.Data, nil)
 
-	err = syncKubernetesSecret(c.Spec.Secret, secret.Data)
+	return secret, nil
+}
+
+// extendLease renews the lease of foundSecret and records the renewed lease
+// in c, along with its max TTL if Vault capped the renewal. It returns the
+// lease duration Vault granted.
+func extendLease(c *CustomSecret, vc *vaultClient, foundSecret *CustomSecretSpec) (int, error) {
+	increment := renewIncrement(*c, foundSecret)
+	renewedSecret, err := vc.renewVaultLease(foundSecret.LeaseID, increment)
 
 	if err != nil {
-		// Delete the Vault secret since we couldn't persist to k8s
-		vltClient.revokeVaultSecret(secret.LeaseID)
+		failuresCounter.inc("vault_renew")
+		auditCustomSecret("renew", *c, foundSecret.LeaseID, nil, err)
+		return 0, errors.New("[Processor] Error renewing lease from Vault: " + err.Error())
+	}
+	operationsCounter.inc("renew")
 
+	c.Spec.LeaseID = renewedSecret.LeaseID
+	c.Spec.LeaseDuration = renewedSecret.LeaseDuration
+	c.Spec.LeaseExpirationDate = time.Now().Add(time.Second * time.Duration(renewedSecret.LeaseDuration))
+
+	// The lease duration returned by a renewal is rounded, so ask Vault when
+	// the lease actually expires
+	issueTime := c.Spec.IssueDate
+	lease, err := vc.lookupVaultLease(renewedSecret.LeaseID)
+	if err != nil {
+		logWarn("Error looking up lease, using the renewed lease duration", customSecretFields(*c).withLease(renewedSecret.LeaseID).with("error", err))
+	} else {
+		c.Spec.LeaseExpirationDate = lease.ExpireTime
+		if !lease.IssueTime.IsZero() {
+			issueTime = lease.IssueTime
+		}
+	}
+
+	requested := time.Now().Add(time.Duration(increment) * time.Second)
+	if c.Spec.LeaseExpirationDate.Before(requested.Add(-leaseCapTolerance)) {
+		// Vault capped the renewal, so the lease is reaching its max TTL
+		if c.Spec.HardExpirationDate.IsZero() {
+			logInfo("Lease is reaching its max TTL",
+				customSecretFields(*c).withLease(c.Spec.LeaseID).with("max_ttl_expiration", c.Spec.LeaseExpirationDate.UTC().Format(time.RFC3339)))
+		}
+		c.Spec.HardExpirationDate = c.Spec.LeaseExpirationDate
+		if !issueTime.IsZero() {
+			c.Spec.MaxTTL = int(c.Spec.HardExpirationDate.Sub(issueTime).Seconds())
+		}
+	}
+
+	c.Spec.RenewAt = renewalTime(*c, renewedSecret.LeaseDuration)
+	auditCustomSecret("renew", *c, c.Spec.LeaseID, nil, nil)
+
+	return renewedSecret.LeaseDuration, nil
+}
+
+// processWrappedCustomSecret stores only a response-wrapping token in the
+// Kubernetes secret. The wrapped credentials are never seen by the controller,
+// so there is no lease to renew; a new wrapping token is requested before the
+// previous one expires. The replaced token is reclaimed shortly before it
+// expires, unless a pod has used it by then.
+func processWrappedCustomSecret(c CustomSecret, db *bolt.DB) error {
+	foundSecret, _ := getSecretLocal(c.Spec.Secret, db)
+
+	carryLocalState(&c.Spec, foundSecret)
+	if foundSecret != nil && foundSecret.PreviousWrapToken != "" && !time.Now().Before(foundSecret.PreviousRevokeDate) {
+		reclaimWrappedLease(&c)
+		foundSecret.PreviousWrapToken = ""
+		foundSecret.PreviousVaultConnection = ""
+		foundSecret.PreviousRevokeDate = time.Time{}
+		persistSecretLocal(c.Spec.Secret, *foundSecret, db)
+	}
+
+	rotateAt, rotationDue := rotationRequested(c, foundSecret)
+	if rotationDue {
+		c.Spec.LastRotateAt = rotateAt
+		logInfo("Rotation requested", customSecretFields(c).with("rotate_at", rotateAt))
+	} else if wrapValid(foundSecret) && !foundSecret.RotateRequested {
+		logDebug("Wrapping token is valid, skipping refresh",
+			customSecretFields(c).with("wrap_expiration", foundSecret.WrapExpirationDate.UTC().Format(time.RFC3339)))
+		return nil
+	}
+
+	vc, err := vltPool.get(c.Spec.VaultConnection)
+	if err != nil {
+		return errors.New("[Processor] Error getting Vault client: " + err.Error())
+	}
+
+	// The token being replaced, read before the secret is overwritten
+	replaced := ""
+	if foundSecret != nil && time.Now().Before(foundSecret.WrapExpirationDate) {
+		current, err := getKubernetesSecret(c.Spec.Secret)
+		if err != nil {
+			logWarn("Error reading the wrapping token being replaced", customSecretFields(c).with("error", err))
+		}
+		replaced = current["wrap_token"]
+	}
+
+	wrapInfo, err := vc.wrapVaultSecret(c.Spec)
+
+	if err != nil {
+		failuresCounter.inc("vault_wrap")
+		auditCustomSecret("wrap", c, "", nil, err)
+		return errors.New("[Processor] Error getting wrapped secret from Vault: " + err.Error())
+	}
+
+	c.Spec.WrapExpirationDate = time.Now().Add(time.Second * time.Duration(wrapInfo.TTL))
+	c.Spec.RenewAt = renewalTime(c, wrapInfo.TTL)
+	c.Spec.IssueDate = time.Now()
+
+	data := map[string]interface{}{
+		"wrap_token":      wrapInfo.Token,
+		"wrap_ttl":        strconv.Itoa(wrapInfo.TTL),
+		"wrap_expiration": c.Spec.WrapExpirationDate.UTC().Format(time.RFC3339),
+	}
+
+	err = syncKubernetesSecret(c.Spec.Secret, data)
+
+	if err != nil {
+		failuresCounter.inc("kubernetes_sync")
 		return errors.New("[Processor] Error creating Kubernetes secret: " + err.Error())
 	}
 
+	if replaced != "" {
+		// Only one replaced token is kept
+		reclaimWrappedLease(&c)
+		c.Spec.PreviousWrapToken = replaced
+		c.Spec.PreviousVaultConnection = foundSecret.VaultConnection
+		c.Spec.PreviousRevokeDate = foundSecret.WrapExpirationDate.Add(-wrapReclaimMargin)
+		if rotationDue {
+			// The replaced token may have leaked
+			reclaimWrappedLease(&c)
+		}
+	}
+
 	// Persist to DB
 	persistSecretLocal(c.Spec.Secret, c.Spec, db)
+	operationsCounter.inc("wrap")
+	auditCustomSecret("wrap", c, "", nil, nil)
+
+	if rotationDue {
+		updateRotationStatus(c, rotateAt)
+	}
+
+	return nil
+}
+
+// wrapReclaimMargin is how long before a replaced wrapping token expires it's
+// reclaimed
+const wrapReclaimMargin = 30 * time.Second
+
+// reclaimWrappedLease unwraps the wrapping token replaced by the last refresh
+// of c and revokes the lease of the credentials in it. Otherwise each refresh
+// of a dynamic secret would leave a lease behind. If a pod has already used
+// the token, the lease is the pod's.
+func reclaimWrappedLease(c *CustomSecret) {
+	token := c.Spec.PreviousWrapToken
+	if token == "" {
+		return
+	}
+	c.Spec.PreviousWrapToken = ""
+	connection := c.Spec.PreviousVaultConnection
+	c.Spec.PreviousVaultConnection = ""
+	c.Spec.PreviousRevokeDate = time.Time{}
 
+	vc, err := vltPool.get(connection)
+	if err != nil {
+		logWarn("Error getting Vault client to reclaim a replaced wrapping token", customSecretFields(*c).with("error", err))
+		return
+	}
+	secret, err := vc.unwrapVaultSecret(token)
+	if err != nil {
+		logInfo("Replaced wrapping token was used or has expired", customSecretFields(*c).with("error", err))
+		return
+	}
+	if secret.LeaseID == "" {
+		return
+	}
+	err = revokeLease(*c, &CustomSecretSpec{LeaseID: secret.LeaseID, VaultConnection: connection})
+	if err != nil {
+		logError("Error revoking the lease of a replaced wrapping token", customSecretFields(*c).withLease(secret.LeaseID).with("error", err))
+	}
+}
+
+// findCustomSecret returns the CustomSecret with the given name, or the one
+// that manages the Kubernetes secret with that name.
+func findCustomSecret(name string) (*CustomSecret, error) {
+	customSecrets, err := getCustomSecrets()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, c := range customSecrets {
+		if c.Metadata["name"] == name || c.Spec.Secret == name {
+			return &c, nil
+		}
+	}
+	return nil, fmt.Errorf("no CustomSecret named %q or managing a secret named %q", name, name)
+}
+
+// rotateCustomSecret issues new credentials now. The previous lease is kept
+// for the rotation grace period, if there's one, or left to expire.
+func rotateCustomSecret(c CustomSecret, db *bolt.DB) error {
+	processorLock.Lock()
+	defer processorLock.Unlock()
+
+	err := requestRotationLocal(c.Spec.Secret, db)
+	if err != nil {
+		return err
+	}
+	return processCustomSecret(c, db)
+}
+
+// renewCustomSecret renews the current lease now, issuing new credentials if
+// it's due to reach its max TTL.
+func renewCustomSecret(c CustomSecret, db *bolt.DB) error {
+	processorLock.Lock()
+	defer processorLock.Unlock()
+
+	foundSecret, err := getSecretLocal(c.Spec.Secret, db)
+	if err != nil {
+		return err
+	}
+	if foundSecret == nil || foundSecret.LeaseID == "" {
+		return fmt.Errorf("no lease stored for secret %q", c.Spec.Secret)
+	}
+
+	err = renewLease(c, foundSecret, db)
+	if err != nil {
+		return err
+	}
+	return processCustomSecret(c, db)
+}
+
+// resyncCustomSecret processes c now rather than waiting for the next sync.
+func resyncCustomSecret(c CustomSecret, db *bolt.DB) error {
+	processorLock.Lock()
+	defer processorLock.Unlock()
+
+	return processCustomSecret(c, db)
+}
+
+// revokeCustomSecret revokes the current lease and issues new credentials.
+func revokeCustomSecret(c CustomSecret, db *bolt.DB) error {
+	processorLock.Lock()
+	defer processorLock.Unlock()
+
+	foundSecret, err := getSecretLocal(c.Spec.Secret, db)
+	if err != nil {
+		return err
+	}
+
+	if foundSecret != nil {
+		err = revokeLease(c, foundSecret)
+		if err != nil {
+			return err
+		}
+	}
+
+	deleteSecretLocal(c.Spec.Secret, db)
+	leaseExpiry.delete(c.Spec.Secret)
+	return processCustomSecret(c, db)
+}
+
+// revokeLease revokes the lease of a secret stored locally, if it has one,
+// with the connection that issued it.
+func revokeLease(c CustomSecret, foundSecret *CustomSecretSpec) error {
+	if foundSecret.LeaseID == "" {
+		return nil
+	}
+
+	vc, err := vltPool.get(foundSecret.VaultConnection)
+	if err != nil {
+		return errors.New("[Processor] Error getting Vault client: " + err.Error())
+	}
+
+	logInfo("Revoking lease", customSecretFields(c).withLease(foundSecret.LeaseID))
+	err = vc.revokeVaultSecret(foundSecret.LeaseID)
+	auditCustomSecret("revoke", c, foundSecret.LeaseID, nil, err)
+	if err != nil {
+		failuresCounter.inc("vault_revoke")
+		return errors.New("[Processor] Error revoking lease from Vault: " + err.Error())
+	}
+	operationsCounter.inc("revoke")
 	return nil
 }
@@ -0,0 +1,199 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// After a rotation, Deployments, StatefulSets and DaemonSets that use the
+// secret are rolled by setting an annotation on their pod template to the
+// new version of the secret.
+var (
+	restartWorkloads = true
+	rolloutInterval  = 30 * time.Second
+)
+
+const (
+	// restartAnnotation on a workload lists, comma separated, secrets to
+	// restart it for besides those it uses directly, or is "false" to never
+	// restart it
+	restartAnnotation = "enterprises.upmc.com/restart-on-rotation"
+
+	// rolloutAnnotationPrefix, followed by the name of a secret, is the pod
+	// template annotation set to the version of the secret
+	rolloutAnnotationPrefix = "rollout.enterprises.upmc.com/"
+)
+
+var workloadKinds = []struct {
+	kind     string
+	endpoint string
+}{
+	{"Deployment", deploymentsEndpoint},
+	{"StatefulSet", statefulSetsEndpoint},
+	{"DaemonSet", daemonSetsEndpoint},
+}
+
+var rollouts = &rolloutQueue{pending: make(map[string]pendingRollout)}
+
+type pendingRollout struct {
+	kind     string
+	endpoint string
+	name     string
+	secret   string
+	version  string
+}
+
+// rolloutQueue rolls at most one workload every rolloutInterval, in the order
+// they were queued. A workload queued again before it's rolled is only rolled
+// once, with the latest version.
+type rolloutQueue struct {
+	sync.Mutex
+	pending map[string]pendingRollout
+	order   []string
+}
+
+func (q *rolloutQueue) add(r pendingRollout) {
+	q.Lock()
+	defer q.Unlock()
+
+	key := r.kind + "/" + r.name + "/" + r.secret
+	if _, ok := q.pending[key]; !ok {
+		q.order = append(q.order, key)
+	}
+	q.pending[key] = r
+}
+
+func (q *rolloutQueue) next() (pendingRollout, bool) {
+	q.Lock()
+	defer q.Unlock()
+
+	if len(q.order) == 0 {
+		return pendingRollout{}, false
+	}
+	key := q.order[0]
+	q.order = q.order[1:]
+	r := q.pending[key]
+	delete(q.pending, key)
+	return r, true
+}
+
+// run rolls queued workloads until done is closed
+func (q *rolloutQueue) run(done chan struct{}) {
+	go func() {
+		for {
+			select {
+			case <-time.After(rolloutInterval):
+				r, ok := q.next()
+				if ok {
+					r.roll()
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+}
+
+// drain rolls every queued workload now, waiting rolloutInterval between
+// two of them. It's for commands run without a controller, where nothing
+// else would roll the workloads they queue. It returns what was done for
+// each secret.
+func (q *rolloutQueue) drain() map[string][]string {
+	done := make(map[string][]string)
+	for first := true; ; first = false {
+		r, ok := q.next()
+		if !ok {
+			return done
+		}
+		if !first {
+			time.Sleep(rolloutInterval)
+		}
+		result := "restarted " + r.kind + " " + r.name
+		if err := r.roll(); err != nil {
+			result = "failed to restart " + r.kind + " " + r.name + ": " + err.Error()
+		}
+		done[r.secret] = append(done[r.secret], result)
+	}
+}
+
+// roll sets the annotation of the workload's pod template to the version of
+// the secret
+func (r pendingRollout) roll() error {
+	fields := logFields{"kind": r.kind, "name": r.name, "secret": r.secret, "version": r.version}
+	err := patchPodTemplateAnnotation(r.endpoint, r.name, secretAnnotation(rolloutAnnotationPrefix, r.secret), r.version)
+	if err != nil {
+		failuresCounter.inc("rollout")
+		logError("Error rolling workload", fields.with("error", err))
+		return err
+	}
+	operationsCounter.inc("rollout")
+	logInfo("Rolling workload after secret rotation", fields)
+	return nil
+}
+
+// queueRollouts queues a rollout of every workload that uses the secret of c
+func queueRollouts(c CustomSecret) {
+	if !restartWorkloads {
+		return
+	}
+
+	for _, k := range workloadKinds {
+		workloads, err := getWorkloads(k.endpoint)
+		if err != nil {
+			logWarn("Error listing workloads to restart", customSecretFields(c).with("kind", k.kind).with("error", err))
+			continue
+		}
+
+		for _, w := range workloads {
+			if !workloadUsesSecret(w, c.Spec.Secret) {
+				continue
+			}
+			logInfo("Queueing workload restart", customSecretFields(c).with("kind", k.kind).with("name", w.Metadata.Name))
+			rollouts.add(pendingRollout{
+				kind:     k.kind,
+				endpoint: k.endpoint,
+				name:     w.Metadata.Name,
+				secret:   c.Spec.Secret,
+				version:  c.Spec.SecretVersion,
+			})
+		}
+	}
+}
+
+func workloadUsesSecret(w Workload, secret string) bool {
+	restart, ok := w.Metadata.Annotations[restartAnnotation]
+	if ok && strings.TrimSpace(restart) == "false" {
+		return false
+	}
+	for _, name := range strings.Split(restart, ",") {
+		if strings.TrimSpace(name) == secret {
+			return true
+		}
+	}
+	return w.Spec.Template.Spec.usesSecret(secret)
+}
@@ -0,0 +1,171 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// maintenanceWindowMargin is how long before the max TTL a maintenance window
+// must start to be worth waiting for
+const maintenanceWindowMargin = 5 * time.Minute
+
+// leaseCapTolerance is how much shorter than requested a renewal can be
+// before it's taken to be capped at the max TTL
+const leaseCapTolerance = 5 * time.Second
+
+// reissueLeadTime is how long before the max TTL new credentials are issued
+var reissueLeadTime = 5 * time.Minute
+
+type maintenanceWindow struct {
+	start    *cronSchedule
+	duration time.Duration
+}
+
+// parseMaintenanceWindow returns nil if spec is nil
+func parseMaintenanceWindow(spec *MaintenanceWindowSpec) (*maintenanceWindow, error) {
+	if spec == nil {
+		return nil, nil
+	}
+
+	start, err := parseCronSchedule(spec.Start)
+	if err != nil {
+		return nil, err
+	}
+	duration, err := time.ParseDuration(spec.Duration)
+	if err != nil {
+		return nil, err
+	}
+	if duration <= 0 {
+		return nil, errors.New("maintenance window duration must be greater than 0")
+	}
+	return &maintenanceWindow{start: start, duration: duration}, nil
+}
+
+func (w *maintenanceWindow) contains(t time.Time) bool {
+	start := w.start.prev(t)
+	return !start.IsZero() && t.Before(start.Add(w.duration))
+}
+
+// hardExpiration returns when the credentials of a secret stored locally
+// reach their max TTL: as reported by Vault once a renewal has been capped,
+// otherwise estimated from the max TTL of earlier credentials. It's the zero
+// time if the max TTL isn't known yet.
+func hardExpiration(s *CustomSecretSpec) time.Time {
+	if !s.HardExpirationDate.IsZero() {
+		return s.HardExpirationDate
+	}
+	if s.MaxTTL == 0 || s.IssueDate.IsZero() {
+		return time.Time{}
+	}
+	return s.IssueDate.Add(time.Duration(s.MaxTTL) * time.Second)
+}
+
+// seedIssueDate asks Vault when the lease of a secret stored locally was
+// issued, for secrets stored before the issue date was recorded. Without it
+// neither the rotation schedule nor the max TTL estimate apply to them.
+func seedIssueDate(c CustomSecret, foundSecret *CustomSecretSpec, db *bolt.DB) {
+	if foundSecret == nil || foundSecret.LeaseID == "" || !foundSecret.IssueDate.IsZero() {
+		return
+	}
+
+	vc, err := vltPool.get(foundSecret.VaultConnection)
+	if err == nil {
+		var lease *vaultLease
+		lease, err = vc.lookupVaultLease(foundSecret.LeaseID)
+		if err == nil && lease.IssueTime.IsZero() {
+			err = errors.New("no issue time returned")
+		}
+		if err == nil {
+			foundSecret.IssueDate = lease.IssueTime
+			err = persistSecretLocal(c.Spec.Secret, *foundSecret, db)
+		}
+	}
+	if err != nil {
+		logWarn("Error looking up when the lease was issued", customSecretFields(c).withLease(foundSecret.LeaseID).with("error", err))
+	}
+}
+
+// reissueTime returns when to issue new credentials to replace those of a
+// secret stored locally before they reach their max TTL, or the zero time if
+// that isn't known yet. The lead time is at most half of the max TTL.
+func reissueTime(s *CustomSecretSpec) time.Time {
+	hardExpiry := hardExpiration(s)
+	if hardExpiry.IsZero() {
+		return time.Time{}
+	}
+	lead := reissueLeadTime
+	if maxTTL := time.Duration(s.MaxTTL) * time.Second; maxTTL > 0 && lead > maxTTL/2 {
+		lead = maxTTL / 2
+	}
+	return hardExpiry.Add(-lead)
+}
+
+// scheduledReissue decides whether the credentials of a secret stored locally
+// should be re-issued now, because of its rotation schedule, because its max
+// TTL is near or because it will be reached before the next maintenance
+// window.
+//
+// Only the rotation schedule needs the issue date. The max TTL checks rely on
+// hardExpiration, which is known once Vault has capped a renewal even for
+// leases stored before the issue date was recorded.
+func scheduledReissue(c CustomSecret, foundSecret *CustomSecretSpec) (string, bool) {
+	if foundSecret == nil {
+		return "", false
+	}
+	now := time.Now()
+
+	if c.Spec.RotationSchedule != "" && !foundSecret.IssueDate.IsZero() {
+		schedule, err := parseCronSchedule(c.Spec.RotationSchedule)
+		if err != nil {
+			logWarn("Invalid rotation schedule, ignoring", customSecretFields(c).with("error", err))
+		} else if foundSecret.IssueDate.Before(schedule.prev(now)) {
+			return "scheduled rotation", true
+		}
+	}
+
+	if t := reissueTime(foundSecret); !t.IsZero() && !now.Before(t) {
+		return "max TTL is near", true
+	}
+
+	window, err := parseMaintenanceWindow(c.Spec.MaintenanceWindow)
+	if err != nil {
+		logWarn("Invalid maintenance window, ignoring", customSecretFields(c).with("error", err))
+		return "", false
+	}
+	hardExpiry := hardExpiration(foundSecret)
+	if window == nil || hardExpiry.IsZero() || !window.contains(now) {
+		return "", false
+	}
+
+	next := window.start.next(now)
+	if next.IsZero() || next.After(hardExpiry.Add(-maintenanceWindowMargin)) {
+		return "max TTL is reached before the next maintenance window", true
+	}
+	return "", false
+}
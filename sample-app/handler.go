@@ -27,5 +27,8 @@ var html = `
 `
 
 func httpHandler(w http.ResponseWriter, req *http.Request) {
-	fmt.Fprintf(w, html, hostname, sl.username, sl.password)
+	secret := sl.Secret()
+	username, _ := secret.String("username")
+	password, _ := secret.String("password")
+	fmt.Fprintf(w, html, hostname, username, password)
 }
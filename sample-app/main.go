@@ -29,33 +29,39 @@ import (
 	"log"
 	"net/http"
 	"os"
+
+	"github.com/upmc-enterprises/kubernetes-secret-manager/secretloader"
 )
 
 var (
-	httpAddr     string
-	usernamePath string
-	passwordPath string
+	httpAddr  string
+	secretDir string
 )
 
 var (
 	hostname string
-	sl       *SecretLoader
+	sl       *secretloader.Loader
 )
 
 func main() {
 	flag.StringVar(&httpAddr, "http", ":80", "HTTP Listen address.")
-	flag.StringVar(&usernamePath, "username-secret-file", "/secrets/username", "Username secret path")
-	flag.StringVar(&passwordPath, "password-secret-file", "/secrets/password", "Password secret path")
+	flag.StringVar(&secretDir, "secret-dir", "/secrets", "Directory the secret is mounted at")
 
 	flag.Parse()
 
 	log.Println("Initializing application...")
 
 	var err error
-	sl, err = NewSecretLoader(usernamePath, passwordPath)
+	sl, err = secretloader.New(secretDir, &secretloader.Options{Required: []string{"username", "password"}})
 	if err != nil {
 		log.Fatal(err)
 	}
+	sl.OnChange(func(old, new *secretloader.Secret) {
+		log.Printf("Reloaded secrets, version %s", new.Version())
+	})
+	sl.OnError(func(err error) {
+		log.Printf("Error reloading secrets: %v", err)
+	})
 	hostname, err = os.Hostname()
 	if err != nil {
 		log.Fatal(err)
@@ -0,0 +1,321 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"container/heap"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// Defaults for the renewalFraction and renewalJitter of a CustomSecret
+var (
+	renewalFraction = 0.5
+	renewalJitter   = 0.1
+)
+
+const (
+	// retryInterval is how long to wait before processing a CustomSecret
+	// again after an error
+	retryInterval = 30 * time.Second
+
+	// gracePeriodCheckInterval is how often to check whether pods have
+	// reloaded a secret during its rotation grace period
+	gracePeriodCheckInterval = 30 * time.Second
+)
+
+// renewalSettings returns the renewal fraction and jitter of c, falling back
+// to the defaults for values out of range
+func renewalSettings(c CustomSecret) (float64, float64) {
+	fraction, jitter := renewalFraction, renewalJitter
+	if c.Spec.RenewalFraction != 0 {
+		if c.Spec.RenewalFraction > 0 && c.Spec.RenewalFraction < 1 {
+			fraction = c.Spec.RenewalFraction
+		} else {
+			logWarn("renewalFraction must be between 0 and 1, ignoring", customSecretFields(c))
+		}
+	}
+	if c.Spec.RenewalJitter != 0 {
+		if c.Spec.RenewalJitter > 0 && c.Spec.RenewalJitter < 1 {
+			jitter = c.Spec.RenewalJitter
+		} else {
+			logWarn("renewalJitter must be between 0 and 1, ignoring", customSecretFields(c))
+		}
+	}
+	return fraction, jitter
+}
+
+// renewalTime returns when to renew a lease of the given duration starting
+// now: after the renewal fraction of the duration, brought forward by a random
+// part, up to the jitter, of that time so leases issued together don't all
+// renew together.
+func renewalTime(c CustomSecret, leaseDuration int) time.Time {
+	fraction, jitter := renewalSettings(c)
+	after := float64(leaseDuration) * fraction * (1 - jitter*rand.Float64())
+	return time.Now().Add(time.Duration(after * float64(time.Second)))
+}
+
+// nextDeadline returns when the secret of c, stored locally as s, next needs
+// processing, or the zero time if only a change to c can make it.
+func nextDeadline(c CustomSecret, s *CustomSecretSpec) time.Time {
+	var deadline time.Time
+	earliest := func(t time.Time) {
+		if !t.IsZero() && (deadline.IsZero() || t.Before(deadline)) {
+			deadline = t
+		}
+	}
+
+	if s.RotateRequested {
+		earliest(time.Now())
+	}
+	if rotateAt := c.Annotations[rotateAtAnnotation]; rotateAt != "" && rotateAt != c.Status.RotateAt && rotateAt != s.LastRotateAt {
+		t, err := time.Parse(time.RFC3339, rotateAt)
+		if err == nil {
+			earliest(t)
+		}
+	}
+
+	if c.Spec.WrapTTL != "" {
+		earliest(s.WrapExpirationDate)
+		earliest(s.RenewAt)
+		if s.PreviousWrapToken != "" {
+			earliest(s.PreviousRevokeDate)
+		}
+		return deadline
+	}
+
+	if s.LeaseID != "" {
+		earliest(s.LeaseExpirationDate)
+		if !s.RenewAt.IsZero() {
+			earliest(s.RenewAt)
+		} else {
+			earliest(s.LeaseExpirationDate.Add(-time.Duration(s.LeaseDuration/2) * time.Second))
+		}
+	}
+
+	earliest(reissueTime(s))
+
+	if c.Spec.RotationSchedule != "" {
+		schedule, err := parseCronSchedule(c.Spec.RotationSchedule)
+		if err == nil {
+			earliest(schedule.next(time.Now()))
+		}
+	}
+	if window, err := parseMaintenanceWindow(c.Spec.MaintenanceWindow); err == nil && window != nil && !hardExpiration(s).IsZero() {
+		earliest(window.start.next(time.Now()))
+	}
+
+	if s.PreviousLeaseID != "" {
+		earliest(s.PreviousRevokeDate)
+		earliest(time.Now().Add(gracePeriodCheckInterval))
+	}
+	return deadline
+}
+
+var leaseSchedule = newScheduler()
+
+type scheduledSecret struct {
+	secret   CustomSecret
+	deadline time.Time
+	index    int
+}
+
+// deadlineHeap orders scheduled secrets by deadline
+type deadlineHeap []*scheduledSecret
+
+func (h deadlineHeap) Len() int           { return len(h) }
+func (h deadlineHeap) Less(i, j int) bool { return h[i].deadline.Before(h[j].deadline) }
+func (h deadlineHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *deadlineHeap) Push(x interface{}) {
+	s := x.(*scheduledSecret)
+	s.index = len(*h)
+	*h = append(*h, s)
+}
+
+func (h *deadlineHeap) Pop() interface{} {
+	old := *h
+	s := old[len(old)-1]
+	*h = old[:len(old)-1]
+	s.index = -1
+	return s
+}
+
+// scheduler keeps the next deadline of each secret, so a secret is processed
+// exactly when work on it is due rather than on every sync
+type scheduler struct {
+	sync.Mutex
+	secrets map[string]*scheduledSecret
+	heap    deadlineHeap
+	wake    chan struct{}
+}
+
+func newScheduler() *scheduler {
+	return &scheduler{
+		secrets: make(map[string]*scheduledSecret),
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+// schedule sets when to process c next, replacing its previous deadline
+func (s *scheduler) schedule(c CustomSecret, deadline time.Time) {
+	s.Lock()
+	defer s.Unlock()
+
+	if item, ok := s.secrets[c.Spec.Secret]; ok {
+		item.secret = c
+		item.deadline = deadline
+		heap.Fix(&s.heap, item.index)
+	} else {
+		item = &scheduledSecret{secret: c, deadline: deadline}
+		s.secrets[c.Spec.Secret] = item
+		heap.Push(&s.heap, item)
+	}
+	s.notify()
+}
+
+func (s *scheduler) remove(name string) {
+	s.Lock()
+	defer s.Unlock()
+
+	if item, ok := s.secrets[name]; ok {
+		heap.Remove(&s.heap, item.index)
+		delete(s.secrets, name)
+		s.notify()
+	}
+}
+
+func (s *scheduler) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// next returns the earliest deadline, or false if nothing is scheduled
+func (s *scheduler) next() (time.Time, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	if len(s.heap) == 0 {
+		return time.Time{}, false
+	}
+	return s.heap[0].deadline, true
+}
+
+// due removes and returns the secrets whose deadline has passed
+func (s *scheduler) due(now time.Time) []CustomSecret {
+	s.Lock()
+	defer s.Unlock()
+
+	var secrets []CustomSecret
+	for len(s.heap) > 0 && !s.heap[0].deadline.After(now) {
+		item := heap.Pop(&s.heap).(*scheduledSecret)
+		delete(s.secrets, item.secret.Spec.Secret)
+		secrets = append(secrets, item.secret)
+	}
+	return secrets
+}
+
+// run processes secrets as their deadlines pass, until done is closed
+func (s *scheduler) run(db *bolt.DB, done chan struct{}, wg *sync.WaitGroup) {
+	go func() {
+		timer := time.NewTimer(0)
+		for {
+			select {
+			case <-timer.C:
+				for _, c := range s.due(time.Now()) {
+					processScheduledSecret(c, db)
+				}
+			case <-s.wake:
+			case <-done:
+				timer.Stop()
+				wg.Done()
+				logInfo("Stopped lease scheduler", nil)
+				return
+			}
+
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			if deadline, ok := s.next(); ok {
+				timer.Reset(deadline.Sub(time.Now()))
+			}
+		}
+	}()
+}
+
+func processScheduledSecret(c CustomSecret, db *bolt.DB) {
+	processorLock.Lock()
+	defer processorLock.Unlock()
+
+	if pausedNamespaces.isPaused(customSecretNamespace(c)) {
+		logDebug("Reconciliation paused, skipping CustomSecret", customSecretFields(c))
+		return
+	}
+
+	id := workQueue.add(c, "scheduled")
+	defer workQueue.done(id)
+	err := processCustomSecret(c, db)
+	if err != nil {
+		logError("Error processing CustomSecret", customSecretFields(c).with("error", err))
+	}
+}
+
+// scheduleCustomSecret schedules c for its next deadline, or for a retry if
+// processing it failed. A deadline that has already passed is treated as a
+// failure, so work that can't be done isn't retried in a loop.
+func scheduleCustomSecret(c CustomSecret, db *bolt.DB, failed bool) {
+	if failed {
+		leaseSchedule.schedule(c, time.Now().Add(retryInterval))
+		return
+	}
+
+	foundSecret, err := getSecretLocal(c.Spec.Secret, db)
+	if err != nil || foundSecret == nil {
+		leaseSchedule.remove(c.Spec.Secret)
+		return
+	}
+	deadline := nextDeadline(c, foundSecret)
+	if deadline.IsZero() {
+		leaseSchedule.remove(c.Spec.Secret)
+		return
+	}
+	if !deadline.After(time.Now()) {
+		deadline = time.Now().Add(retryInterval)
+	}
+	logDebug("Scheduled CustomSecret", customSecretFields(c).with("deadline", deadline.UTC().Format(time.RFC3339)))
+	leaseSchedule.schedule(c, deadline)
+}
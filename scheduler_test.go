@@ -0,0 +1,194 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func scheduledNames(secrets []CustomSecret) []string {
+	var names []string
+	for _, c := range secrets {
+		names = append(names, c.Spec.Secret)
+	}
+	return names
+}
+
+func testCustomSecret(name string) CustomSecret {
+	return CustomSecret{Spec: CustomSecretSpec{Secret: name}}
+}
+
+func TestSchedulerOrder(t *testing.T) {
+	s := newScheduler()
+	now := time.Now()
+	s.schedule(testCustomSecret("c"), now.Add(3*time.Minute))
+	s.schedule(testCustomSecret("a"), now.Add(time.Minute))
+	s.schedule(testCustomSecret("d"), now.Add(4*time.Minute))
+	s.schedule(testCustomSecret("b"), now.Add(2*time.Minute))
+
+	if next, ok := s.next(); !ok || !next.Equal(now.Add(time.Minute)) {
+		t.Errorf("next = %s, %v, want %s", next, ok, now.Add(time.Minute))
+	}
+	if due := s.due(now); len(due) != 0 {
+		t.Errorf("due before any deadline = %v, want none", scheduledNames(due))
+	}
+	if due := scheduledNames(s.due(now.Add(3 * time.Minute))); !reflect.DeepEqual(due, []string{"a", "b", "c"}) {
+		t.Errorf("due = %v, want [a b c]", due)
+	}
+	if due := scheduledNames(s.due(now.Add(time.Hour))); !reflect.DeepEqual(due, []string{"d"}) {
+		t.Errorf("due = %v, want [d]", due)
+	}
+	if _, ok := s.next(); ok {
+		t.Error("next reported a deadline with nothing scheduled")
+	}
+}
+
+func TestSchedulerReschedule(t *testing.T) {
+	s := newScheduler()
+	now := time.Now()
+	s.schedule(testCustomSecret("a"), now.Add(time.Minute))
+	s.schedule(testCustomSecret("b"), now.Add(2*time.Minute))
+
+	later := testCustomSecret("a")
+	later.Spec.Policy = "database/creds/app"
+	s.schedule(later, now.Add(3*time.Minute))
+
+	if next, _ := s.next(); !next.Equal(now.Add(2 * time.Minute)) {
+		t.Errorf("next after rescheduling = %s, want %s", next, now.Add(2*time.Minute))
+	}
+	due := s.due(now.Add(time.Hour))
+	if names := scheduledNames(due); !reflect.DeepEqual(names, []string{"b", "a"}) {
+		t.Fatalf("due = %v, want [b a]", names)
+	}
+	if due[1].Spec.Policy != "database/creds/app" {
+		t.Errorf("rescheduled secret has policy %q, want the latest CustomSecret", due[1].Spec.Policy)
+	}
+
+	// Bringing a deadline forward works the same way
+	s.schedule(testCustomSecret("a"), now.Add(time.Hour))
+	s.schedule(testCustomSecret("b"), now.Add(2*time.Hour))
+	s.schedule(testCustomSecret("b"), now.Add(time.Minute))
+	if names := scheduledNames(s.due(now.Add(time.Minute))); !reflect.DeepEqual(names, []string{"b"}) {
+		t.Errorf("due = %v, want [b]", names)
+	}
+}
+
+func TestSchedulerRemove(t *testing.T) {
+	s := newScheduler()
+	now := time.Now()
+	for i, name := range []string{"a", "b", "c"} {
+		s.schedule(testCustomSecret(name), now.Add(time.Duration(i+1)*time.Minute))
+	}
+
+	s.remove("a")
+	s.remove("missing")
+	if next, _ := s.next(); !next.Equal(now.Add(2 * time.Minute)) {
+		t.Errorf("next after removing the earliest = %s, want %s", next, now.Add(2*time.Minute))
+	}
+	s.remove("c")
+	if names := scheduledNames(s.due(now.Add(time.Hour))); !reflect.DeepEqual(names, []string{"b"}) {
+		t.Errorf("due = %v, want [b]", names)
+	}
+	if len(s.secrets) != 0 {
+		t.Errorf("%d secrets left after all were removed or due", len(s.secrets))
+	}
+}
+
+func TestScheduleCustomSecret(t *testing.T) {
+	previous := leaseSchedule
+	leaseSchedule = newScheduler()
+	t.Cleanup(func() { leaseSchedule = previous })
+
+	db := openTestDB(t)
+	now := time.Now()
+	stored := map[string]CustomSecretSpec{
+		"expired": {
+			Secret:              "expired",
+			LeaseID:             "database/creds/app/expired",
+			LeaseDuration:       3600,
+			LeaseExpirationDate: now.Add(-time.Minute),
+			RenewAt:             now.Add(-time.Hour),
+		},
+		"valid": {
+			Secret:              "valid",
+			LeaseID:             "database/creds/app/valid",
+			LeaseDuration:       3600,
+			LeaseExpirationDate: now.Add(time.Hour),
+			RenewAt:             now.Add(10 * time.Minute),
+		},
+	}
+	for name, spec := range stored {
+		if err := persistSecretLocal(name, spec, db); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deadline := func(name string) (time.Time, bool) {
+		leaseSchedule.Lock()
+		defer leaseSchedule.Unlock()
+		item, ok := leaseSchedule.secrets[name]
+		if !ok {
+			return time.Time{}, false
+		}
+		return item.deadline, true
+	}
+	retryWindow := func(name string, before time.Time) {
+		t.Helper()
+		got, ok := deadline(name)
+		if !ok {
+			t.Fatalf("%s was not scheduled", name)
+		}
+		if got.Before(before.Add(retryInterval)) || got.After(time.Now().Add(retryInterval)) {
+			t.Errorf("%s scheduled for %s, want a retry in %s", name, got, retryInterval)
+		}
+	}
+
+	before := time.Now()
+	scheduleCustomSecret(testCustomSecret("valid"), db, false)
+	if got, ok := deadline("valid"); !ok || !got.Equal(stored["valid"].RenewAt) {
+		t.Errorf("valid scheduled for %s, %v, want its renewal at %s", got, ok, stored["valid"].RenewAt)
+	}
+
+	scheduleCustomSecret(testCustomSecret("expired"), db, false)
+	retryWindow("expired", before)
+
+	before = time.Now()
+	scheduleCustomSecret(testCustomSecret("valid"), db, true)
+	retryWindow("valid", before)
+
+	scheduleCustomSecret(testCustomSecret("missing"), db, false)
+	if _, ok := deadline("missing"); ok {
+		t.Error("a secret that isn't stored was scheduled")
+	}
+	if err := deleteSecretLocal("valid", db); err != nil {
+		t.Fatal(err)
+	}
+	scheduleCustomSecret(testCustomSecret("valid"), db, false)
+	if _, ok := deadline("valid"); ok {
+		t.Error("a deleted secret is still scheduled")
+	}
+}
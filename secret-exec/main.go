@@ -0,0 +1,338 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+// secret-exec runs a command with the keys of a mounted secret as environment
+// variables, for programs that only read credentials from their environment.
+// When the Kubernetes Secret Manager rotates the secret, the command is
+// restarted with the new values, or sent a signal. Like dumb-init it forwards
+// signals to the command and reaps zombie processes, so it can be the
+// entrypoint of a container.
+//
+//	ENTRYPOINT ["/secret-exec", "-secret-dir=/secrets", "-env-prefix=DB_", "--", "/app"]
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/upmc-enterprises/kubernetes-secret-manager/secretloader"
+)
+
+// Actions taken when the secret rotates
+const (
+	onRotationRestart = "restart"
+	onRotationSignal  = "signal"
+	onRotationNone    = "none"
+)
+
+var (
+	secretDir     string
+	envPrefix     string
+	envMap        string
+	keepCase      bool
+	onRotation    string
+	signalName    string
+	restartGrace  time.Duration
+	debounce      time.Duration
+	rotationDelay time.Duration
+)
+
+func main() {
+	flag.StringVar(&secretDir, "secret-dir", "/secrets", "Directory the secret is mounted at.")
+	flag.StringVar(&envPrefix, "env-prefix", "", "Prefix of the environment variable names.")
+	flag.StringVar(&envMap, "env-map", "", "Comma separated key=NAME pairs naming the variables of some keys. Other keys are named after the key, upper-cased, with characters other than letters, digits and _ replaced by _.")
+	flag.BoolVar(&keepCase, "keep-case", false, "Don't upper-case the names of variables.")
+	flag.StringVar(&onRotation, "on-rotation", onRotationRestart, "What to do when the secret rotates: restart, signal or none.")
+	flag.StringVar(&signalName, "signal", "SIGHUP", "Signal sent to the command when the secret rotates, with -on-rotation=signal.")
+	flag.DurationVar(&restartGrace, "restart-grace-period", 10*time.Second, "How long the command has to exit after SIGTERM when restarting, before it's killed.")
+	flag.DurationVar(&debounce, "debounce", secretloader.DefaultDebounce, "How long to wait after the secret changes before acting on it.")
+	flag.DurationVar(&rotationDelay, "rotation-delay", 0, "How long to wait after the secret rotates before restarting or signalling the command.")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] [--] command [args...]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	log.SetPrefix("secret-exec: ")
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	rotationSignal, ok := signals[strings.TrimPrefix(strings.ToUpper(signalName), "SIG")]
+	if !ok {
+		log.Fatalf("unknown signal %s", signalName)
+	}
+	if onRotation != onRotationRestart && onRotation != onRotationSignal && onRotation != onRotationNone {
+		log.Fatalf("unknown -on-rotation %s", onRotation)
+	}
+	names, err := parseEnvMap(envMap)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	loader, err := secretloader.New(secretDir, &secretloader.Options{Debounce: debounce})
+	if err != nil {
+		log.Fatal(err)
+	}
+	rotations := make(chan struct{}, 1)
+	loader.OnChange(func(old, new *secretloader.Secret) {
+		log.Printf("secret rotated to version %s", new.Version())
+		select {
+		case rotations <- struct{}{}:
+		default:
+		}
+	})
+	loader.OnError(func(err error) {
+		log.Printf("error reloading secret: %v", err)
+	})
+
+	becomeSubreaper()
+
+	// Every signal is forwarded to the command, except those the runtime
+	// uses itself
+	sigs := make(chan os.Signal, 32)
+	signal.Notify(sigs)
+
+	s := &supervisor{args: flag.Args(), loader: loader, names: names}
+	err = s.start()
+	if err != nil {
+		log.Fatal(err)
+	}
+	os.Exit(s.run(sigs, rotations, rotationSignal))
+}
+
+// supervisor runs the command and restarts it on rotation
+type supervisor struct {
+	args   []string
+	loader *secretloader.Loader
+	names  map[string]string
+
+	pid        int
+	restarting bool
+	stopping   bool
+}
+
+func (s *supervisor) start() error {
+	cmd := exec.Command(s.args[0], s.args[1:]...)
+	cmd.Env = environ(os.Environ(), s.loader.Secret(), s.names)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	// Run the command in its own session, so signals can be sent to every
+	// process it starts
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+
+	err := cmd.Start()
+	if err != nil {
+		return err
+	}
+	s.pid = cmd.Process.Pid
+	log.Printf("started %s (pid %d) with secret version %s", s.args[0], s.pid, s.loader.Version())
+	return nil
+}
+
+// signal sends sig to every process of the command's session
+func (s *supervisor) signal(sig syscall.Signal) {
+	err := syscall.Kill(-s.pid, sig)
+	if err != nil && err != syscall.ESRCH {
+		log.Printf("error sending %s: %v", sig, err)
+	}
+}
+
+// run handles signals and rotations until the command exits, other than to
+// be restarted, and returns the exit code to exit with
+func (s *supervisor) run(sigs chan os.Signal, rotations chan struct{}, rotationSignal syscall.Signal) int {
+	var kill, delayed <-chan time.Time
+	for {
+		select {
+		case sig := <-sigs:
+			switch sig {
+			case syscall.SIGCHLD:
+				status, exited := s.reap()
+				if !exited {
+					continue
+				}
+				if s.restarting && !s.stopping {
+					s.restarting = false
+					kill = nil
+					err := s.start()
+					if err != nil {
+						log.Printf("error restarting %s: %v", s.args[0], err)
+						return 1
+					}
+					continue
+				}
+				return exitCode(status)
+			case syscall.SIGURG, syscall.SIGPIPE:
+				// Used by the Go runtime, or caused by this process
+			default:
+				if sig == syscall.SIGTERM || sig == syscall.SIGINT {
+					s.stopping = true
+				}
+				s.signal(sig.(syscall.Signal))
+			}
+
+		case <-rotations:
+			if rotationDelay > 0 {
+				delayed = time.After(rotationDelay)
+				continue
+			}
+			kill = s.rotated(rotationSignal, kill)
+
+		case <-delayed:
+			delayed = nil
+			kill = s.rotated(rotationSignal, kill)
+
+		case <-kill:
+			kill = nil
+			log.Printf("%s didn't exit within %s, killing it", s.args[0], restartGrace)
+			s.signal(syscall.SIGKILL)
+		}
+	}
+}
+
+// rotated acts on a rotation of the secret, returning when to kill the
+// command if it's being restarted
+func (s *supervisor) rotated(rotationSignal syscall.Signal, kill <-chan time.Time) <-chan time.Time {
+	if s.stopping || s.restarting {
+		return kill
+	}
+	switch onRotation {
+	case onRotationSignal:
+		log.Printf("sending %s to %s", rotationSignal, s.args[0])
+		s.signal(rotationSignal)
+	case onRotationRestart:
+		log.Printf("restarting %s", s.args[0])
+		s.restarting = true
+		s.signal(syscall.SIGTERM)
+		return time.After(restartGrace)
+	}
+	return kill
+}
+
+// reap waits for every child that has exited, including orphans inherited
+// as PID 1 or as a subreaper, and returns the status of the command if it's
+// one of them
+func (s *supervisor) reap() (syscall.WaitStatus, bool) {
+	var commandStatus syscall.WaitStatus
+	exited := false
+	for {
+		var status syscall.WaitStatus
+		pid, err := syscall.Wait4(-1, &status, syscall.WNOHANG, nil)
+		if err == syscall.EINTR {
+			continue
+		}
+		if pid <= 0 || err != nil {
+			return commandStatus, exited
+		}
+		if pid == s.pid {
+			commandStatus = status
+			exited = true
+		}
+	}
+}
+
+func exitCode(status syscall.WaitStatus) int {
+	if status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+	return status.ExitStatus()
+}
+
+// parseEnvMap parses key=NAME pairs
+func parseEnvMap(s string) (map[string]string, error) {
+	names := make(map[string]string)
+	if s == "" {
+		return names, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid -env-map entry %q, expected key=NAME", pair)
+		}
+		names[parts[0]] = parts[1]
+	}
+	return names, nil
+}
+
+// envName returns the name of the variable for a key of the secret
+func envName(key string, names map[string]string) string {
+	if name, ok := names[key]; ok {
+		return name
+	}
+	name := envPrefix + key
+	if !keepCase {
+		name = strings.ToUpper(name)
+	}
+	name = strings.Map(func(r rune) rune {
+		if r == '_' || r >= '0' && r <= '9' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' {
+			return r
+		}
+		return '_'
+	}, name)
+	if name[0] >= '0' && name[0] <= '9' {
+		name = "_" + name
+	}
+	return name
+}
+
+// environ returns base with the keys of the secret added, replacing
+// variables of the same name
+func environ(base []string, secret *secretloader.Secret, names map[string]string) []string {
+	vars := make(map[string]string, len(base))
+	for _, kv := range base {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) == 2 {
+			vars[parts[0]] = parts[1]
+		}
+	}
+	for k, v := range secret.Map() {
+		vars[envName(k, names)] = v
+	}
+
+	env := make([]string, 0, len(vars))
+	for k, v := range vars {
+		env = append(env, k+"="+v)
+	}
+	sort.Strings(env)
+	return env
+}
+
+var signals = map[string]syscall.Signal{
+	"HUP":  syscall.SIGHUP,
+	"INT":  syscall.SIGINT,
+	"QUIT": syscall.SIGQUIT,
+	"TERM": syscall.SIGTERM,
+	"USR1": syscall.SIGUSR1,
+	"USR2": syscall.SIGUSR2,
+}
@@ -0,0 +1,253 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package secretloader
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+)
+
+// Connector is a database/sql driver.Connector that opens every connection
+// with the latest credentials held by a Loader. Connections opened with
+// credentials that have since been rotated keep working until they're
+// returned to the pool, and are then closed rather than reused, so a rotation
+// doesn't interrupt queries in progress.
+//
+//	db := sql.OpenDB(secretloader.NewConnector(loader, mysql.MySQLDriver{}, secretloader.MySQLDSN("mysql:3306", "app")))
+type Connector struct {
+	loader *Loader
+	driver driver.Driver
+	dsn    func(*Secret) (string, error)
+
+	// Logf logs rotations and retired connections. It defaults to
+	// log.Printf.
+	Logf func(format string, v ...interface{})
+
+	mu         sync.Mutex
+	open       map[string]int
+	connectors map[string]driver.Connector
+}
+
+// NewConnector returns a Connector opening connections with d, using the DSN
+// returned by dsn for the latest secret of loader.
+func NewConnector(loader *Loader, d driver.Driver, dsn func(*Secret) (string, error)) *Connector {
+	c := &Connector{
+		loader:     loader,
+		driver:     d,
+		dsn:        dsn,
+		Logf:       log.Printf,
+		open:       make(map[string]int),
+		connectors: make(map[string]driver.Connector),
+	}
+	loader.OnChange(c.rotated)
+	return c
+}
+
+// MySQLDSN returns a DSN function for the github.com/go-sql-driver/mysql
+// driver, reading the username and password keys of the secret.
+func MySQLDSN(address, database string) func(*Secret) (string, error) {
+	return func(s *Secret) (string, error) {
+		username, ok := s.String("username")
+		if !ok {
+			return "", errors.New("secretloader: no username in secret")
+		}
+		password, ok := s.String("password")
+		if !ok {
+			return "", errors.New("secretloader: no password in secret")
+		}
+		return fmt.Sprintf("%s:%s@tcp(%s)/%s", username, password, address, database), nil
+	}
+}
+
+// Connect opens a connection with the latest credentials.
+func (c *Connector) Connect(ctx context.Context) (driver.Conn, error) {
+	secret := c.loader.Secret()
+	dsn, err := c.dsn(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	var inner driver.Conn
+	if dc, ok := c.driver.(driver.DriverContext); ok {
+		connector, err := c.connector(dc, secret.Version(), dsn)
+		if err != nil {
+			return nil, err
+		}
+		inner, err = connector.Connect(ctx)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		inner, err = c.driver.Open(dsn)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	c.mu.Lock()
+	c.open[secret.Version()]++
+	c.mu.Unlock()
+	return &conn{Conn: inner, connector: c, version: secret.Version()}, nil
+}
+
+// Driver returns the underlying driver.
+func (c *Connector) Driver() driver.Driver {
+	return c.driver
+}
+
+// connector returns the driver's connector for a version of the
+// credentials, dropping those of older versions
+func (c *Connector) connector(dc driver.DriverContext, version, dsn string) (driver.Connector, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if connector, ok := c.connectors[version]; ok {
+		return connector, nil
+	}
+	connector, err := dc.OpenConnector(dsn)
+	if err != nil {
+		return nil, err
+	}
+	c.connectors = map[string]driver.Connector{version: connector}
+	return connector, nil
+}
+
+func (c *Connector) rotated(old, new *Secret) {
+	c.mu.Lock()
+	stale := 0
+	for version, n := range c.open {
+		if version != new.Version() {
+			stale += n
+		}
+	}
+	c.mu.Unlock()
+
+	c.Logf("secretloader: database credentials rotated from version %s to %s; new connections use them, %d connections opened with older credentials are retired once idle",
+		old.Version(), new.Version(), stale)
+}
+
+func (c *Connector) closed(version string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.open[version]--
+	if c.open[version] <= 0 {
+		delete(c.open, version)
+	}
+}
+
+func (c *Connector) current(version string) bool {
+	return version == c.loader.Version()
+}
+
+// conn is a connection that knows which version of the credentials it was
+// opened with. It passes everything else through to the driver's connection.
+type conn struct {
+	driver.Conn
+	connector *Connector
+	version   string
+	closeOnce sync.Once
+}
+
+func (c *conn) Close() error {
+	c.closeOnce.Do(func() {
+		c.connector.closed(c.version)
+		if !c.connector.current(c.version) {
+			c.connector.Logf("secretloader: retired database connection opened with credentials version %s", c.version)
+		}
+	})
+	return c.Conn.Close()
+}
+
+// IsValid is called by database/sql before reusing a connection from the
+// pool, and when one is returned to it.
+func (c *conn) IsValid() bool {
+	if !c.connector.current(c.version) {
+		return false
+	}
+	if v, ok := c.Conn.(driver.Validator); ok {
+		return v.IsValid()
+	}
+	return true
+}
+
+func (c *conn) ResetSession(ctx context.Context) error {
+	if !c.connector.current(c.version) {
+		return driver.ErrBadConn
+	}
+	if r, ok := c.Conn.(driver.SessionResetter); ok {
+		return r.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c *conn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	if p, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		return p.PrepareContext(ctx, query)
+	}
+	return c.Conn.Prepare(query)
+}
+
+func (c *conn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if b, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return b.BeginTx(ctx, opts)
+	}
+	if opts.Isolation != 0 || opts.ReadOnly {
+		return nil, errors.New("secretloader: driver does not support transaction options")
+	}
+	return c.Conn.Begin()
+}
+
+func (c *conn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if e, ok := c.Conn.(driver.ExecerContext); ok {
+		return e.ExecContext(ctx, query, args)
+	}
+	return nil, driver.ErrSkip
+}
+
+func (c *conn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if q, ok := c.Conn.(driver.QueryerContext); ok {
+		return q.QueryContext(ctx, query, args)
+	}
+	return nil, driver.ErrSkip
+}
+
+func (c *conn) Ping(ctx context.Context) error {
+	if p, ok := c.Conn.(driver.Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+func (c *conn) CheckNamedValue(v *driver.NamedValue) error {
+	if n, ok := c.Conn.(driver.NamedValueChecker); ok {
+		return n.CheckNamedValue(v)
+	}
+	return driver.ErrSkip
+}
@@ -0,0 +1,298 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package secretloader
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeDriver is a database driver whose connections answer every query with
+// the DSN they were opened with, and which counts its open connections
+type fakeDriver struct {
+	mu     sync.Mutex
+	open   map[string]int
+	opened []string
+}
+
+func newFakeDriver() *fakeDriver {
+	return &fakeDriver{open: make(map[string]int)}
+}
+
+func (d *fakeDriver) Open(dsn string) (driver.Conn, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.open[dsn]++
+	d.opened = append(d.opened, dsn)
+	return &fakeConn{driver: d, dsn: dsn}, nil
+}
+
+func (d *fakeDriver) openConns(dsn string) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.open[dsn]
+}
+
+// fakeContextDriver also implements driver.DriverContext
+type fakeContextDriver struct {
+	*fakeDriver
+	connectors int
+}
+
+func (d *fakeContextDriver) OpenConnector(dsn string) (driver.Connector, error) {
+	d.connectors++
+	return fakeConnector{d, dsn}, nil
+}
+
+type fakeConnector struct {
+	d   *fakeContextDriver
+	dsn string
+}
+
+func (c fakeConnector) Connect(context.Context) (driver.Conn, error) { return c.d.Open(c.dsn) }
+func (c fakeConnector) Driver() driver.Driver                        { return c.d }
+
+type fakeConn struct {
+	driver *fakeDriver
+	dsn    string
+	closed bool
+}
+
+func (c *fakeConn) Prepare(string) (driver.Stmt, error) { return nil, errors.New("not supported") }
+func (c *fakeConn) Begin() (driver.Tx, error)           { return nil, errors.New("not supported") }
+
+func (c *fakeConn) Close() error {
+	c.driver.mu.Lock()
+	defer c.driver.mu.Unlock()
+	if c.closed {
+		return errors.New("closed twice")
+	}
+	c.closed = true
+	c.driver.open[c.dsn]--
+	return nil
+}
+
+func (c *fakeConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if c.closed {
+		return nil, driver.ErrBadConn
+	}
+	return &dsnRows{dsn: c.dsn}, nil
+}
+
+// dsnRows is a single row holding a DSN
+type dsnRows struct {
+	dsn  string
+	done bool
+}
+
+func (r *dsnRows) Columns() []string { return []string{"dsn"} }
+func (r *dsnRows) Close() error      { return nil }
+
+func (r *dsnRows) Next(dest []driver.Value) error {
+	if r.done {
+		return io.EOF
+	}
+	r.done = true
+	dest[0] = r.dsn
+	return nil
+}
+
+func queryDSN(t *testing.T, q interface {
+	QueryRowContext(context.Context, string, ...interface{}) *sql.Row
+}) string {
+	t.Helper()
+	var dsn string
+	if err := q.QueryRowContext(context.Background(), "SELECT dsn").Scan(&dsn); err != nil {
+		t.Fatal(err)
+	}
+	return dsn
+}
+
+func userDSN(s *Secret) (string, error) {
+	user, ok := s.String("username")
+	if !ok {
+		return "", errors.New("no username")
+	}
+	return "dsn-" + user, nil
+}
+
+func (c *Connector) openConns() map[string]int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	open := make(map[string]int, len(c.open))
+	for k, v := range c.open {
+		open[k] = v
+	}
+	return open
+}
+
+func TestConnectorRotation(t *testing.T) {
+	for _, withContext := range []bool{false, true} {
+		t.Run(fmt.Sprintf("DriverContext=%v", withContext), func(t *testing.T) {
+			fake := newFakeDriver()
+			var d driver.Driver = fake
+			if withContext {
+				d = &fakeContextDriver{fakeDriver: fake}
+			}
+
+			w := newAtomicWriter(t)
+			w.write(generation(1))
+			l, err := New(w.dir, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+			oldVersion := l.Version()
+
+			var logs []string
+			var logsMu sync.Mutex
+			c := NewConnector(l, d, userDSN)
+			c.Logf = func(format string, v ...interface{}) {
+				logsMu.Lock()
+				logs = append(logs, fmt.Sprintf(format, v...))
+				logsMu.Unlock()
+			}
+
+			db := sql.OpenDB(c)
+			db.SetMaxIdleConns(5)
+			ctx := context.Background()
+
+			// One connection stays busy through the rotation, another idles
+			// in the pool
+			busy, err := db.Conn(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			idle, err := db.Conn(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if dsn := queryDSN(t, busy); dsn != "dsn-user-1" {
+				t.Fatalf("busy connection uses %s", dsn)
+			}
+			idle.Close()
+			if got := c.openConns()[oldVersion]; got != 2 {
+				t.Fatalf("%d open connections for version 1, want 2", got)
+			}
+
+			w.write(generation(2))
+			if err := l.Reload(); err != nil {
+				t.Fatal(err)
+			}
+			newVersion := l.Version()
+
+			// New connections use the rotated DSN; the idle connection is
+			// retired rather than reused
+			if dsn := queryDSN(t, db); dsn != "dsn-user-2" {
+				t.Fatalf("new connection uses %s", dsn)
+			}
+			if n := fake.openConns("dsn-user-1"); n != 1 {
+				t.Fatalf("%d connections with the old DSN open, want only the busy one", n)
+			}
+
+			// A query in progress isn't interrupted
+			if dsn := queryDSN(t, busy); dsn != "dsn-user-1" {
+				t.Fatalf("busy connection uses %s", dsn)
+			}
+			busy.Close()
+			if n := fake.openConns("dsn-user-1"); n != 0 {
+				t.Fatalf("%d connections with the old DSN open after release", n)
+			}
+			if got, ok := c.openConns()[oldVersion]; ok {
+				t.Fatalf("%d connections counted for the old version", got)
+			}
+			if got := c.openConns()[newVersion]; got != 1 {
+				t.Fatalf("%d connections counted for the new version, want 1", got)
+			}
+
+			// Connections with current credentials are reused
+			for i := 0; i < 3; i++ {
+				queryDSN(t, db)
+			}
+			if got := c.openConns()[newVersion]; got != 1 {
+				t.Fatalf("%d connections for the new version, want the one reused", got)
+			}
+
+			db.Close()
+			if open := c.openConns(); len(open) != 0 {
+				t.Fatalf("open after Close: %v", open)
+			}
+			if n := fake.openConns("dsn-user-2"); n != 0 {
+				t.Fatalf("%d driver connections open after Close", n)
+			}
+			if cd, ok := d.(*fakeContextDriver); ok && cd.connectors != 2 {
+				t.Errorf("%d driver connectors opened, want one per version", cd.connectors)
+			}
+
+			logsMu.Lock()
+			defer logsMu.Unlock()
+			joined := strings.Join(logs, "\n")
+			if !strings.Contains(joined, "rotated from version "+oldVersion+" to "+newVersion) ||
+				!strings.Contains(joined, "retired database connection opened with credentials version "+oldVersion) {
+				t.Errorf("unexpected logs:\n%s", joined)
+			}
+		})
+	}
+}
+
+func TestConnectorDSNError(t *testing.T) {
+	w := newAtomicWriter(t)
+	w.write(map[string]string{"password": "secret"})
+	l, err := New(w.dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	fake := newFakeDriver()
+	db := sql.OpenDB(NewConnector(l, fake, userDSN))
+	defer db.Close()
+	if err := db.Ping(); err == nil {
+		t.Fatal("connected without a username")
+	}
+	if len(fake.opened) != 0 {
+		t.Fatalf("driver opened %v", fake.opened)
+	}
+}
+
+func TestMySQLDSN(t *testing.T) {
+	dsn, err := MySQLDSN("mysql:3306", "app")(newSecret(map[string][]byte{
+		"username": []byte("v-app-1"),
+		"password": []byte("p4ss"),
+	}))
+	if err != nil || dsn != "v-app-1:p4ss@tcp(mysql:3306)/app" {
+		t.Errorf("MySQLDSN = %q, %v", dsn, err)
+	}
+	if _, err := MySQLDSN("mysql:3306", "app")(newSecret(map[string][]byte{"username": []byte("v-app-1")})); err == nil {
+		t.Error("MySQLDSN succeeded without a password")
+	}
+}
@@ -0,0 +1,289 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+// Package secretloader keeps the keys of a secret mounted into a pod in
+// memory, and reloads them when the Kubernetes Secret Manager rotates the
+// secret. Kubernetes updates a secret volume by writing the new keys to a
+// fresh directory and swapping the ..data symlink to point at it; the loader
+// watches for that swap, debounces the events it causes and reads every key
+// from the same directory, so an update is never seen half applied.
+package secretloader
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Defaults for Options
+const (
+	DefaultDebounce     = 250 * time.Millisecond
+	DefaultPollInterval = time.Minute
+)
+
+// dataDir is the symlink kubelet swaps to update a secret volume atomically
+const dataDir = "..data"
+
+// Options configure a Loader. The zero value uses the defaults.
+type Options struct {
+	// Debounce is how long to wait after a change to the directory before
+	// reloading, so the several events of one update cause one reload
+	Debounce time.Duration
+
+	// PollInterval is how often to reload even without a change being
+	// seen, in case one was missed. On platforms without inotify it's the
+	// only way changes are seen.
+	PollInterval time.Duration
+
+	// Required keys must be present for the secret to be loaded. An update
+	// without them is reported as an error and the current secret is kept.
+	Required []string
+}
+
+// Loader holds the latest version of a secret mounted at a directory.
+type Loader struct {
+	dir  string
+	opts Options
+
+	mu        sync.RWMutex
+	secret    *Secret
+	onChange  []func(old, new *Secret)
+	onError   []func(error)
+	lastError error
+
+	reload chan struct{}
+	done   chan struct{}
+	once   sync.Once
+}
+
+// New loads the secret mounted at dir and starts watching it for updates.
+// opts may be nil.
+func New(dir string, opts *Options) (*Loader, error) {
+	l := &Loader{
+		dir:    dir,
+		reload: make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+	if opts != nil {
+		l.opts = *opts
+	}
+	if l.opts.Debounce <= 0 {
+		l.opts.Debounce = DefaultDebounce
+	}
+	if l.opts.PollInterval <= 0 {
+		l.opts.PollInterval = DefaultPollInterval
+	}
+
+	secret, err := l.read()
+	if err != nil {
+		return nil, err
+	}
+	l.secret = secret
+
+	err = watch(dir, l.changed, l.done)
+	if err != nil {
+		return nil, err
+	}
+	go l.run()
+
+	return l, nil
+}
+
+// Secret returns the latest version of the secret.
+func (l *Loader) Secret() *Secret {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.secret
+}
+
+// Bytes returns the value of key in the latest version of the secret.
+func (l *Loader) Bytes(key string) ([]byte, bool) { return l.Secret().Bytes(key) }
+
+// String returns the value of key in the latest version of the secret.
+func (l *Loader) String(key string) (string, bool) { return l.Secret().String(key) }
+
+// Version returns the version of the latest secret.
+func (l *Loader) Version() string { return l.Secret().Version() }
+
+// OnChange registers fn to be called, from the loader's goroutine, with the
+// previous and the new secret each time the secret changes.
+func (l *Loader) OnChange(fn func(old, new *Secret)) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.onChange = append(l.onChange, fn)
+}
+
+// OnError registers fn to be called, from the loader's goroutine, each time
+// reloading the secret fails. The previous secret is kept.
+func (l *Loader) OnError(fn func(error)) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.onError = append(l.onError, fn)
+}
+
+// Err returns the error of the last reload, or nil if it succeeded.
+func (l *Loader) Err() error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.lastError
+}
+
+// Reload reads the secret now, calling the OnChange callbacks if it changed.
+func (l *Loader) Reload() error {
+	secret, err := l.read()
+
+	l.mu.Lock()
+	l.lastError = err
+	old := l.secret
+	changed := err == nil && secret.Version() != old.Version()
+	if changed {
+		l.secret = secret
+	}
+	onChange := l.onChange
+	onError := l.onError
+	l.mu.Unlock()
+
+	if err != nil {
+		for _, fn := range onError {
+			fn(err)
+		}
+		return err
+	}
+	if changed {
+		for _, fn := range onChange {
+			fn(old, secret)
+		}
+	}
+	return nil
+}
+
+// Close stops watching the secret.
+func (l *Loader) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *Loader) changed() {
+	select {
+	case l.reload <- struct{}{}:
+	default:
+	}
+}
+
+func (l *Loader) run() {
+	poll := time.NewTicker(l.opts.PollInterval)
+	defer poll.Stop()
+
+	var debounce <-chan time.Time
+	for {
+		select {
+		case <-l.reload:
+			debounce = time.After(l.opts.Debounce)
+		case <-debounce:
+			debounce = nil
+			l.Reload()
+		case <-poll.C:
+			l.Reload()
+		case <-l.done:
+			return
+		}
+	}
+}
+
+// maxReadAttempts bounds how often read starts over because the secret was
+// updated while it was being read
+const maxReadAttempts = 5
+
+// read reads every key of the secret. Keys are read from the directory the
+// ..data symlink points to, if there is one, so they all come from the same
+// update. Kubelet only removes that directory after swapping ..data, so if
+// ..data still points to it once every key was read, none was missed;
+// otherwise the secret is read again.
+func (l *Loader) read() (*Secret, error) {
+	link := filepath.Join(l.dir, dataDir)
+	for attempt := 1; ; attempt++ {
+		target, err := filepath.EvalSymlinks(link)
+		if os.IsNotExist(err) {
+			// Not a secret volume, the keys are plain files
+			return l.readDir(l.dir)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		secret, err := l.readDir(target)
+		current, currentErr := filepath.EvalSymlinks(link)
+		if currentErr == nil && current == target {
+			return secret, err
+		}
+		if attempt == maxReadAttempts {
+			return nil, errors.New("secretloader: " + l.dir + " kept changing while being read")
+		}
+	}
+}
+
+// readDir reads every key in dir and checks the required keys are there
+func (l *Loader) readDir(dir string) (*Secret, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	data := make(map[string][]byte, len(entries))
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, "..") {
+			continue
+		}
+		path := filepath.Join(dir, name)
+		info, err := os.Stat(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				// Removed by an update in progress; the update
+				// triggers another reload
+				continue
+			}
+			return nil, err
+		}
+		if info.IsDir() {
+			continue
+		}
+		value, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		data[name] = value
+	}
+
+	for _, key := range l.opts.Required {
+		if _, ok := data[key]; !ok {
+			return nil, errors.New("secretloader: required key " + key + " missing from " + l.dir)
+		}
+	}
+	return newSecret(data), nil
+}
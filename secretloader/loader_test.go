@@ -0,0 +1,405 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package secretloader
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// atomicWriter updates a directory the way kubelet's AtomicWriter updates a
+// secret volume: the keys are written to a new ..<timestamp> directory, a
+// ..data_tmp symlink to it is renamed over ..data, each key is a symlink
+// through ..data, and the previous directory is removed.
+type atomicWriter struct {
+	t   *testing.T
+	dir string
+	n   int
+}
+
+func newAtomicWriter(t *testing.T) *atomicWriter {
+	dir, err := ioutil.TempDir("", "secretloader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return &atomicWriter{t: t, dir: dir}
+}
+
+func (w *atomicWriter) write(data map[string]string) {
+	w.t.Helper()
+	w.n++
+	ts := fmt.Sprintf("..%s.%d", time.Now().Format("2006_01_02_15_04_05"), w.n)
+	if err := os.Mkdir(filepath.Join(w.dir, ts), 0755); err != nil {
+		w.t.Fatal(err)
+	}
+	for k, v := range data {
+		if err := ioutil.WriteFile(filepath.Join(w.dir, ts, k), []byte(v), 0644); err != nil {
+			w.t.Fatal(err)
+		}
+	}
+
+	previous, _ := os.Readlink(filepath.Join(w.dir, dataDir))
+	tmp := filepath.Join(w.dir, "..data_tmp")
+	if err := os.Symlink(ts, tmp); err != nil {
+		w.t.Fatal(err)
+	}
+	if err := os.Rename(tmp, filepath.Join(w.dir, dataDir)); err != nil {
+		w.t.Fatal(err)
+	}
+
+	for k := range data {
+		link := filepath.Join(w.dir, k)
+		if _, err := os.Lstat(link); os.IsNotExist(err) {
+			if err := os.Symlink(filepath.Join(dataDir, k), link); err != nil {
+				w.t.Fatal(err)
+			}
+		}
+	}
+	entries, err := ioutil.ReadDir(w.dir)
+	if err != nil {
+		w.t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if _, ok := data[entry.Name()]; !ok && !strings.HasPrefix(entry.Name(), "..") {
+			os.Remove(filepath.Join(w.dir, entry.Name()))
+		}
+	}
+	if previous != "" {
+		os.RemoveAll(filepath.Join(w.dir, previous))
+	}
+}
+
+// generation returns credentials whose values all name generation n, so a
+// secret mixing two updates can be told apart
+func generation(n int) map[string]string {
+	return map[string]string{
+		"username": fmt.Sprintf("user-%d", n),
+		"password": fmt.Sprintf("password-%d", n),
+		"host":     fmt.Sprintf("db-%d.example.com", n),
+	}
+}
+
+func assertGeneration(t *testing.T, s *Secret, n int) {
+	t.Helper()
+	want := generation(n)
+	if got := s.Map(); len(got) != len(want) {
+		t.Fatalf("got keys %v, want generation %d", s.Keys(), n)
+	}
+	for k, v := range want {
+		if got, _ := s.String(k); got != v {
+			t.Fatalf("%s = %q, want %q", k, got, v)
+		}
+	}
+}
+
+// changes records OnChange callbacks
+type changes struct {
+	sync.Mutex
+	calls [][2]*Secret
+	c     chan struct{}
+}
+
+func recordChanges(l *Loader) *changes {
+	ch := &changes{c: make(chan struct{}, 100)}
+	l.OnChange(func(old, new *Secret) {
+		ch.Lock()
+		ch.calls = append(ch.calls, [2]*Secret{old, new})
+		ch.Unlock()
+		ch.c <- struct{}{}
+	})
+	return ch
+}
+
+func (ch *changes) wait(t *testing.T) {
+	t.Helper()
+	select {
+	case <-ch.c:
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnChange wasn't called")
+	}
+}
+
+func (ch *changes) count() int {
+	ch.Lock()
+	defer ch.Unlock()
+	return len(ch.calls)
+}
+
+func skipWithoutInotify(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("changes are only watched on Linux")
+	}
+}
+
+func TestLoaderInitialSecret(t *testing.T) {
+	w := newAtomicWriter(t)
+	w.write(generation(1))
+
+	l, err := New(w.dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	assertGeneration(t, l.Secret(), 1)
+	if got := strings.Join(l.Secret().Keys(), ","); got != "host,password,username" {
+		t.Errorf("keys = %s", got)
+	}
+	if v, ok := l.String("username"); !ok || v != "user-1" {
+		t.Errorf("String(username) = %q, %v", v, ok)
+	}
+	if _, ok := l.Bytes("missing"); ok {
+		t.Error("Bytes(missing) found a value")
+	}
+	if l.Version() != version(map[string][]byte{
+		"host":     []byte("db-1.example.com"),
+		"password": []byte("password-1"),
+		"username": []byte("user-1"),
+	}) {
+		t.Errorf("unexpected version %s", l.Version())
+	}
+}
+
+func TestLoaderSwap(t *testing.T) {
+	skipWithoutInotify(t)
+	w := newAtomicWriter(t)
+	w.write(generation(1))
+
+	debounce := 50 * time.Millisecond
+	l, err := New(w.dir, &Options{Debounce: debounce, PollInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	ch := recordChanges(l)
+
+	for n := 2; n <= 4; n++ {
+		w.write(generation(n))
+		ch.wait(t)
+
+		// Nothing else may follow from the same swap
+		time.Sleep(4 * debounce)
+		if got := ch.count(); got != n-1 {
+			t.Fatalf("%d OnChange calls after %d swaps", got, n-1)
+		}
+
+		call := ch.calls[n-2]
+		assertGeneration(t, call[0], n-1)
+		assertGeneration(t, call[1], n)
+		assertGeneration(t, l.Secret(), n)
+		if l.Version() != call[1].Version() || call[0].Version() == call[1].Version() {
+			t.Fatalf("versions: loader %s, old %s, new %s", l.Version(), call[0].Version(), call[1].Version())
+		}
+	}
+}
+
+func TestLoaderDebounce(t *testing.T) {
+	skipWithoutInotify(t)
+	w := newAtomicWriter(t)
+	w.write(generation(1))
+
+	debounce := 300 * time.Millisecond
+	l, err := New(w.dir, &Options{Debounce: debounce, PollInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	ch := recordChanges(l)
+
+	// A burst of updates within the debounce time is one change
+	for n := 2; n <= 5; n++ {
+		w.write(generation(n))
+	}
+	ch.wait(t)
+	time.Sleep(2 * debounce)
+
+	if got := ch.count(); got != 1 {
+		t.Fatalf("%d OnChange calls, want 1", got)
+	}
+	assertGeneration(t, ch.calls[0][0], 1)
+	assertGeneration(t, ch.calls[0][1], 5)
+}
+
+func TestLoaderRequired(t *testing.T) {
+	skipWithoutInotify(t)
+	w := newAtomicWriter(t)
+	w.write(map[string]string{"username": "user-1"})
+
+	opts := &Options{Debounce: 20 * time.Millisecond, PollInterval: time.Hour, Required: []string{"username", "password"}}
+	if _, err := New(w.dir, opts); err == nil {
+		t.Fatal("New succeeded without a required key")
+	}
+
+	w.write(generation(1))
+	l, err := New(w.dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	ch := recordChanges(l)
+	errs := make(chan error, 10)
+	l.OnError(func(err error) { errs <- err })
+
+	// An update missing a required key is reported and the secret is kept
+	w.write(map[string]string{"username": "user-2", "host": "db-2.example.com"})
+	select {
+	case err := <-errs:
+		if !strings.Contains(err.Error(), "password") {
+			t.Errorf("unexpected error %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnError wasn't called")
+	}
+	if l.Err() == nil {
+		t.Error("Err() = nil after a failed reload")
+	}
+	assertGeneration(t, l.Secret(), 1)
+	if ch.count() != 0 {
+		t.Fatal("OnChange was called for an incomplete update")
+	}
+
+	// The next complete update is loaded and clears the error
+	w.write(generation(3))
+	ch.wait(t)
+	assertGeneration(t, ch.calls[0][0], 1)
+	assertGeneration(t, ch.calls[0][1], 3)
+	if err := l.Err(); err != nil {
+		t.Errorf("Err() = %v after a successful reload", err)
+	}
+}
+
+func TestLoaderConsistentUnderUpdates(t *testing.T) {
+	w := newAtomicWriter(t)
+	w.write(generation(0))
+
+	l, err := New(w.dir, &Options{Debounce: time.Millisecond, PollInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// Reloading while kubelet swaps ..data never mixes two updates
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for n := 1; n <= 50; n++ {
+			w.write(generation(n))
+		}
+	}()
+	defer func() { <-done }()
+
+	for finished := false; !finished; {
+		select {
+		case <-done:
+			finished = true
+		default:
+		}
+		if err := l.Reload(); err != nil {
+			t.Fatal(err)
+		}
+		s := l.Secret()
+		user, _ := s.String("username")
+		var n int
+		if _, err := fmt.Sscanf(user, "user-%d", &n); err != nil {
+			t.Fatalf("read a partial secret: %v", s.Map())
+		}
+		assertGeneration(t, s, n)
+	}
+	assertGeneration(t, l.Secret(), 50)
+}
+
+func TestLoaderWithoutDataSymlink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secretloader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for k, v := range generation(1) {
+		if err := ioutil.WriteFile(filepath.Join(dir, k), []byte(v), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	l, err := New(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	assertGeneration(t, l.Secret(), 1)
+}
+
+func TestSecretGetters(t *testing.T) {
+	s := newSecret(map[string][]byte{
+		"port":    []byte("5432\n"),
+		"tls":     []byte(" true "),
+		"timeout": []byte("1m30s"),
+		"hosts":   []byte(`["a","b"]`),
+		"bad":     []byte("x"),
+	})
+
+	if n, err := s.Int("port"); err != nil || n != 5432 {
+		t.Errorf("Int(port) = %d, %v", n, err)
+	}
+	if b, err := s.Bool("tls"); err != nil || !b {
+		t.Errorf("Bool(tls) = %v, %v", b, err)
+	}
+	if d, err := s.Duration("timeout"); err != nil || d != 90*time.Second {
+		t.Errorf("Duration(timeout) = %s, %v", d, err)
+	}
+	var hosts []string
+	if err := s.JSON("hosts", &hosts); err != nil || strings.Join(hosts, ",") != "a,b" {
+		t.Errorf("JSON(hosts) = %v, %v", hosts, err)
+	}
+
+	if _, err := s.Int("bad"); err == nil {
+		t.Error("Int(bad) succeeded")
+	}
+	if _, err := s.Int("missing"); err != ErrNotFound {
+		t.Errorf("Int(missing) error = %v", err)
+	}
+	if _, err := s.Bool("missing"); err != ErrNotFound {
+		t.Errorf("Bool(missing) error = %v", err)
+	}
+	if _, err := s.Duration("missing"); err != ErrNotFound {
+		t.Errorf("Duration(missing) error = %v", err)
+	}
+	if err := s.JSON("missing", &hosts); err != ErrNotFound {
+		t.Errorf("JSON(missing) error = %v", err)
+	}
+
+	b, _ := s.Bytes("port")
+	b[0] = 'X'
+	if v, _ := s.String("port"); v != "5432\n" {
+		t.Error("Bytes returned the secret's own slice")
+	}
+}
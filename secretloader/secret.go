@@ -0,0 +1,153 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package secretloader
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrNotFound is returned by the typed getters of a Secret for a missing key.
+var ErrNotFound = errors.New("secretloader: key not found")
+
+// Secret is one version of a secret. It never changes once loaded.
+type Secret struct {
+	data    map[string][]byte
+	version string
+}
+
+func newSecret(data map[string][]byte) *Secret {
+	return &Secret{data: data, version: version(data)}
+}
+
+// version is the first 12 hex digits of the SHA-256 hash of the keys and
+// values, sorted by key, each followed by a NUL byte. It's the version the
+// controller expects in the reloaded.enterprises.upmc.com/<secret> annotation
+// of a pod.
+func version(data map[string][]byte) string {
+	keys := make([]string, 0, len(data))
+	for k := range data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	h := sha256.New()
+	for _, k := range keys {
+		h.Write([]byte(k + "\x00"))
+		h.Write(data[k])
+		h.Write([]byte("\x00"))
+	}
+	return hex.EncodeToString(h.Sum(nil))[:12]
+}
+
+// Version identifies the contents of the secret.
+func (s *Secret) Version() string {
+	return s.version
+}
+
+// Keys returns the keys of the secret, sorted.
+func (s *Secret) Keys() []string {
+	keys := make([]string, 0, len(s.data))
+	for k := range s.data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Bytes returns a copy of the value of key.
+func (s *Secret) Bytes(key string) ([]byte, bool) {
+	value, ok := s.data[key]
+	if !ok {
+		return nil, false
+	}
+	return append([]byte(nil), value...), true
+}
+
+// String returns the value of key.
+func (s *Secret) String(key string) (string, bool) {
+	value, ok := s.data[key]
+	return string(value), ok
+}
+
+// Map returns every key and value of the secret.
+func (s *Secret) Map() map[string]string {
+	m := make(map[string]string, len(s.data))
+	for k, v := range s.data {
+		m[k] = string(v)
+	}
+	return m
+}
+
+func (s *Secret) trimmed(key string) (string, error) {
+	value, ok := s.data[key]
+	if !ok {
+		return "", ErrNotFound
+	}
+	return strings.TrimSpace(string(value)), nil
+}
+
+// Int parses the value of key as a decimal integer.
+func (s *Secret) Int(key string) (int, error) {
+	value, err := s.trimmed(key)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(value)
+}
+
+// Bool parses the value of key with strconv.ParseBool.
+func (s *Secret) Bool(key string) (bool, error) {
+	value, err := s.trimmed(key)
+	if err != nil {
+		return false, err
+	}
+	return strconv.ParseBool(value)
+}
+
+// Duration parses the value of key with time.ParseDuration.
+func (s *Secret) Duration(key string) (time.Duration, error) {
+	value, err := s.trimmed(key)
+	if err != nil {
+		return 0, err
+	}
+	return time.ParseDuration(value)
+}
+
+// JSON decodes the value of key into v. The controller stores values Vault
+// returns that aren't strings as JSON.
+func (s *Secret) JSON(key string, v interface{}) error {
+	value, ok := s.data[key]
+	if !ok {
+		return ErrNotFound
+	}
+	return json.Unmarshal(value, v)
+}
@@ -0,0 +1,144 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package secretloader
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Keys of a Kubernetes TLS secret
+const (
+	TLSCertKey = "tls.crt"
+	TLSKeyKey  = "tls.key"
+)
+
+// CertReloader serves the certificate and key held by a Loader, for use as
+// the GetCertificate hook of a server or the GetClientCertificate hook of a
+// client. A new pair is only used once it has been validated; if it's
+// invalid the previous certificate is kept.
+//
+//	server := &http.Server{TLSConfig: &tls.Config{GetCertificate: reloader.GetCertificate}}
+type CertReloader struct {
+	// Logf logs certificate changes and rejected pairs. It defaults to
+	// log.Printf.
+	Logf func(format string, v ...interface{})
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	lastErr error
+}
+
+// NewCertReloader returns a CertReloader for the tls.crt and tls.key keys of
+// loader's secret. It fails if the current pair isn't valid.
+func NewCertReloader(loader *Loader) (*CertReloader, error) {
+	cert, err := loadKeyPair(loader.Secret())
+	if err != nil {
+		return nil, err
+	}
+
+	r := &CertReloader{Logf: log.Printf, cert: cert}
+	loader.OnChange(r.rotated)
+	return r, nil
+}
+
+// loadKeyPair parses and validates the certificate and key of a secret:
+// the key must match the certificate, and the certificate must be valid now.
+func loadKeyPair(s *Secret) (*tls.Certificate, error) {
+	certPEM, ok := s.Bytes(TLSCertKey)
+	if !ok {
+		return nil, errors.New("secretloader: no " + TLSCertKey + " in secret")
+	}
+	keyPEM, ok := s.Bytes(TLSKeyKey)
+	if !ok {
+		return nil, errors.New("secretloader: no " + TLSKeyKey + " in secret")
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if now.Before(cert.Leaf.NotBefore) {
+		return nil, fmt.Errorf("secretloader: certificate not valid until %s", cert.Leaf.NotBefore.UTC().Format(time.RFC3339))
+	}
+	if now.After(cert.Leaf.NotAfter) {
+		return nil, fmt.Errorf("secretloader: certificate expired at %s", cert.Leaf.NotAfter.UTC().Format(time.RFC3339))
+	}
+	return &cert, nil
+}
+
+func (r *CertReloader) rotated(old, new *Secret) {
+	cert, err := loadKeyPair(new)
+
+	r.mu.Lock()
+	r.lastErr = err
+	if err == nil {
+		r.cert = cert
+	}
+	r.mu.Unlock()
+
+	if err != nil {
+		r.Logf("secretloader: keeping the current certificate, the new one is invalid: %v", err)
+		return
+	}
+	r.Logf("secretloader: loaded certificate for %s, valid until %s",
+		cert.Leaf.Subject.CommonName, cert.Leaf.NotAfter.UTC().Format(time.RFC3339))
+}
+
+// Certificate returns the certificate being served.
+func (r *CertReloader) Certificate() *tls.Certificate {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert
+}
+
+// Err returns why the last certificate update was rejected, or nil if it
+// was used.
+func (r *CertReloader) Err() error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.lastErr
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.Certificate(), nil
+}
+
+// GetClientCertificate implements tls.Config.GetClientCertificate.
+func (r *CertReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return r.Certificate(), nil
+}
@@ -0,0 +1,97 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+// parseLeaseDuration parses a duration field of c into seconds, returning 0,
+// with a warning, if it isn't a positive duration
+func parseLeaseDuration(c CustomSecret, field, value string) int {
+	if value == "" {
+		return 0
+	}
+	d, err := time.ParseDuration(value)
+	if err == nil && d < time.Second {
+		err = errors.New("must be at least 1s")
+	}
+	if err != nil {
+		logWarn("Invalid lease duration, ignoring", customSecretFields(c).with("field", field).with("value", value).with("error", err))
+		return 0
+	}
+	return int(d.Seconds())
+}
+
+// leaseTTL returns the TTL, in seconds, to request new credentials for c
+// with, or 0 to take the default of the Vault role. It's clamped to the max
+// TTL once that's known.
+func leaseTTL(c CustomSecret) int {
+	ttl := parseLeaseDuration(c, "ttl", c.Spec.TTL)
+	if c.Spec.MaxTTL > 0 && ttl > c.Spec.MaxTTL {
+		ttl = c.Spec.MaxTTL
+	}
+	return ttl
+}
+
+// renewIncrement returns the increment, in seconds, to renew the lease of a
+// secret stored locally by: the renewIncrement of c, or else the current
+// lease duration. It's clamped to what's left until the max TTL once that's
+// known.
+func renewIncrement(c CustomSecret, foundSecret *CustomSecretSpec) int {
+	increment := parseLeaseDuration(c, "renewIncrement", c.Spec.RenewIncrement)
+	if increment == 0 {
+		increment = foundSecret.LeaseDuration
+	}
+	if hardExpiry := hardExpiration(foundSecret); !hardExpiry.IsZero() {
+		left := int(hardExpiry.Sub(time.Now()).Seconds())
+		if left > 0 && increment > left {
+			increment = left
+		}
+	}
+	return increment
+}
+
+// updateLeaseStatus records in the status of c the TTL Vault granted the
+// current credentials, if ttl isn't 0, and the increment it granted the last
+// renewal, if increment isn't 0
+func updateLeaseStatus(c CustomSecret, ttl, increment int) {
+	var status CustomSecretStatus
+	if ttl > 0 {
+		status.TTL = (time.Duration(ttl) * time.Second).String()
+	}
+	if increment > 0 {
+		status.RenewIncrement = (time.Duration(increment) * time.Second).String()
+	}
+	if (status.TTL == "" || status.TTL == c.Status.TTL) && (status.RenewIncrement == "" || status.RenewIncrement == c.Status.RenewIncrement) {
+		return
+	}
+
+	err := patchCustomSecretStatus(c.Metadata["name"], status)
+	if err != nil {
+		logWarn("Error updating CustomSecret status", customSecretFields(c).with("error", err))
+	}
+}
@@ -0,0 +1,109 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+// Package unwrap exchanges the response-wrapping token written by the
+// Kubernetes Secret Manager for the wrapped secret. It is meant to be used by
+// applications or init containers that mount a wrapped secret.
+package unwrap
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	vaultapi "github.com/hashicorp/vault/api"
+)
+
+// TokenKey is the key of the Kubernetes secret that holds the wrapping token.
+const TokenKey = "wrap_token"
+
+// Unwrap reads the wrapping token from the mounted secret directory and
+// exchanges it with Vault at vaultURL for the wrapped secret data. The
+// standard VAULT_* environment variables (e.g. VAULT_CACERT) are honored.
+// A wrapping token can only be used once.
+func Unwrap(vaultURL, secretDir string) (map[string]interface{}, error) {
+	token, err := ioutil.ReadFile(filepath.Join(secretDir, TokenKey))
+	if err != nil {
+		return nil, err
+	}
+
+	config := vaultapi.DefaultConfig()
+	if err := config.ReadEnvironment(); err != nil {
+		return nil, err
+	}
+	if vaultURL != "" {
+		config.Address = vaultURL
+	}
+
+	client, err := vaultapi.NewClient(config)
+	if err != nil {
+		return nil, err
+	}
+
+	secret, err := client.Logical().Unwrap(strings.TrimSpace(string(token)))
+	if err != nil {
+		return nil, err
+	}
+	if secret.Data == nil {
+		return nil, errors.New("wrapped response contains no data")
+	}
+
+	return secret.Data, nil
+}
+
+// UnwrapToDir unwraps the secret mounted at secretDir and writes each key to
+// its own file in outDir, mirroring the layout of a Kubernetes secret volume.
+// outDir is typically an in-memory emptyDir shared with the application.
+func UnwrapToDir(vaultURL, secretDir, outDir string) error {
+	data, err := Unwrap(vaultURL, secretDir)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(outDir, 0700)
+	if err != nil {
+		return err
+	}
+
+	for k, v := range data {
+		value, ok := v.(string)
+		if !ok {
+			// Match the controller, which stores non-string values as JSON
+			b, err := json.Marshal(v)
+			if err != nil {
+				return err
+			}
+			value = string(b)
+		}
+		err = ioutil.WriteFile(filepath.Join(outDir, k), []byte(value), 0600)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -25,31 +25,236 @@ ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
 package main
 
 import (
-	"log"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
 
 	vaultapi "github.com/hashicorp/vault/api"
 )
 
+// serviceAccountTokenPath is where the pod's service account token is mounted
+var serviceAccountTokenPath = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+
 type vaultClient struct {
-	client *vaultapi.Client
+	client  *vaultapi.Client
+	breaker *circuitBreaker
+	// probe sends requests without retries, for health checks
+	probe http.RoundTripper
 }
 
-func newVaultClient(token, vaultURL string) (*vaultClient, error) {
-	config := &vaultapi.Config{
+// vaultProbeTimeout bounds the token lookup of the readiness probe
+var vaultProbeTimeout = 5 * time.Second
+
+func newVaultClient(token, vaultURL string, tlsSpec VaultTLSSpec) (*vaultClient, error) {
+	vc, err := newVaultConnectionClient(VaultConnectionSpec{
 		Address: vaultURL,
+		TLS:     tlsSpec,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Set token in Vault
+	redactor.add(token)
+	vc.client.SetToken(token)
+
+	return vc, nil
+}
+
+// newVaultConnectionClient creates a client for a VaultConnection. The client
+// is not authenticated; call login before using it.
+func newVaultConnectionClient(spec VaultConnectionSpec) (*vaultClient, error) {
+	config := vaultapi.DefaultConfig()
+	config.Address = spec.Address
+
+	// Retries are handled by retryTransport
+	config.MaxRetries = 0
+
+	transport, err := newTLSReloadingTransport(spec.TLS)
+	if err != nil {
+		logError("Error configuring Vault TLS", logFields{"vault_address": spec.Address, "error": err})
+		return nil, err
+	}
+	config.HttpClient.Transport = transport
+
+	if spec.Namespace != "" {
+		config.HttpClient.Transport = &namespaceTransport{
+			namespace: spec.Namespace,
+			transport: config.HttpClient.Transport,
+		}
+	}
+
+	config.HttpClient.Transport = &latencyTransport{config.HttpClient.Transport, vaultLatency}
+	probe := config.HttpClient.Transport
+
+	breaker := newCircuitBreaker()
+	config.HttpClient.Transport = &retryTransport{
+		transport: config.HttpClient.Transport,
+		breaker:   breaker,
 	}
 
 	client, err := vaultapi.NewClient(config)
+	if err != nil {
+		logError("Error creating Vault client", logFields{"vault_address": spec.Address, "error": err})
+		return nil, err
+	}
+
+	return &vaultClient{client: client, breaker: breaker, probe: probe}, nil
+}
+
+// namespaceTransport sets the Vault Enterprise namespace header on every
+// request, since the Vault API client has no support for namespaces.
+type namespaceTransport struct {
+	namespace string
+	transport http.RoundTripper
+}
 
+func (t *namespaceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	r := new(http.Request)
+	*r = *req
+	r.Header = make(http.Header)
+	for k, v := range req.Header {
+		r.Header[k] = v
+	}
+	r.Header.Set("X-Vault-Namespace", t.namespace)
+	return t.transport.RoundTrip(r)
+}
+
+// login authenticates the client with the given auth method and sets the
+// resulting token. Credentials are the data of the Kubernetes secret
+// referenced by the auth spec.
+func (vc *vaultClient) login(auth VaultAuthSpec, credentials map[string]string) (*vaultapi.SecretAuth, error) {
+	method := auth.Method
+	if method == "" {
+		method = "token"
+	}
+	mount := auth.Mount
+	if mount == "" {
+		mount = method
+	}
+
+	var body map[string]interface{}
+	for _, v := range credentials {
+		redactor.add(v)
+	}
+
+	switch method {
+	case "token":
+		vc.client.SetToken(credentials["token"])
+		secret, err := vc.client.Logical().Read("auth/token/lookup-self")
+		if err != nil {
+			return nil, err
+		}
+		if secret == nil {
+			return nil, errors.New("token lookup returned no data")
+		}
+		var ttl int64
+		if n, ok := secret.Data["ttl"].(json.Number); ok {
+			ttl, _ = n.Int64()
+		}
+		renewable, _ := secret.Data["renewable"].(bool)
+		return &vaultapi.SecretAuth{
+			ClientToken:   credentials["token"],
+			LeaseDuration: int(ttl),
+			Renewable:     renewable,
+		}, nil
+	case "approle":
+		body = map[string]interface{}{
+			"role_id":   credentials["role_id"],
+			"secret_id": credentials["secret_id"],
+		}
+	case "kubernetes":
+		jwt, err := ioutil.ReadFile(serviceAccountTokenPath)
+		if err != nil {
+			return nil, err
+		}
+		body = map[string]interface{}{
+			"role": auth.Role,
+			"jwt":  string(jwt),
+		}
+	default:
+		return nil, errors.New("unsupported auth method: " + method)
+	}
+
+	secret, err := vc.client.Logical().Write("auth/"+mount+"/login", body)
 	if err != nil {
-		log.Println("ERROR creating Vault client! ", err)
+		logError("Error logging in to Vault", logFields{"auth_method": method, "error": err})
 		return nil, err
 	}
+	if secret == nil || secret.Auth == nil {
+		return nil, errors.New("login returned no auth data")
+	}
+	redactor.add(secret.Auth.ClientToken)
 
-	// Set token in Vault
-	client.SetToken(vaultToken)
+	vc.client.SetToken(secret.Auth.ClientToken)
+
+	return secret.Auth, nil
+}
+
+// revokeSelf revokes the client's token, along with the leases issued with it
+func (vc *vaultClient) revokeSelf() error {
+	return vc.client.Auth().Token().RevokeSelf("")
+}
+
+// renewSelf renews the client's token for its default increment
+func (vc *vaultClient) renewSelf() (*vaultapi.SecretAuth, error) {
+	secret, err := vc.client.Auth().Token().RenewSelf(0)
+	if err != nil {
+		return nil, err
+	}
+	if secret == nil || secret.Auth == nil {
+		return nil, errors.New("token renewal returned no auth data")
+	}
+	return secret.Auth, nil
+}
 
-	return &vaultClient{client}, nil
+// tokenTTL looks up how long the client's token is valid for. It fails if
+// the token has expired or been revoked.
+func (vc *vaultClient) tokenTTL() (time.Duration, error) {
+	secret, err := vc.client.Auth().Token().LookupSelf()
+	if err != nil {
+		return 0, err
+	}
+	if secret == nil {
+		return 0, errors.New("token lookup returned no data")
+	}
+	n, ok := secret.Data["ttl"].(json.Number)
+	if !ok {
+		return 0, errors.New("token lookup returned no TTL")
+	}
+	ttl, err := n.Int64()
+	if err != nil {
+		return 0, err
+	}
+	return time.Second * time.Duration(ttl), nil
+}
+
+// lookupSelf checks that the client's token is valid. It's used by the
+// readiness probe, so the request isn't retried and fails straight away
+// while the circuit breaker is open.
+func (vc *vaultClient) lookupSelf() error {
+	if vc.breaker.status().State == breakerOpen {
+		return errCircuitOpen
+	}
+
+	req, err := vc.client.NewRequest("GET", "/v1/auth/token/lookup-self").ToHTTP()
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Transport: vc.probe, Timeout: vaultProbeTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("token lookup failed: " + resp.Status)
+	}
+	return nil
 }
 
 func (vc *vaultClient) readVaultSecret(key string) (*vaultapi.Secret, error) {
@@ -60,44 +265,253 @@ func (vc *vaultClient) readVaultSecret(key string) (*vaultapi.Secret, error) {
 	readSecret, err := c.Read(key)
 
 	if err != nil {
-		log.Println("[Vault] Error getting secret: ", err)
+		logError("Error getting secret from Vault", logFields{"vault_path": key, "error": err})
+		return nil, err
+	}
+	registerVaultSecret(readSecret)
+
+	return readSecret, nil
+}
+
+// readVaultSecretTTL reads key, asking for a lease of ttl seconds
+func (vc *vaultClient) readVaultSecretTTL(key string, ttl int) (*vaultapi.Secret, error) {
+	r := vc.client.NewRequest("GET", "/v1/"+key)
+	r.Params.Set("ttl", fmt.Sprintf("%ds", ttl))
+
+	resp, err := vc.client.RawRequest(r)
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	if resp != nil && resp.StatusCode == 404 {
+		return nil, nil
+	}
+	if err != nil {
+		logError("Error getting secret from Vault", logFields{"vault_path": key, "error": err})
+		return nil, err
+	}
+
+	readSecret, err := vaultapi.ParseSecret(resp.Body)
+	if err != nil {
+		logError("Error getting secret from Vault", logFields{"vault_path": key, "error": err})
 		return nil, err
 	}
+	registerVaultSecret(readSecret)
 
 	return readSecret, nil
 }
 
-func (vc *vaultClient) writeVaultSecret(key string, data map[string]interface{}) error {
+func (vc *vaultClient) writeVaultSecret(key string, data map[string]interface{}) (*vaultapi.Secret, error) {
 
 	c := vc.client.Logical()
-	_, err := c.Write(key, data)
+	writeSecret, err := c.Write(key, data)
 
 	if err != nil {
-		log.Println("[Vault] Error writing secret: ", err)
-		return err
+		logError("Error writing secret to Vault", logFields{"vault_path": key, "error": err})
+		return nil, err
 	}
+	registerVaultSecret(writeSecret)
 
-	return nil
+	return writeSecret, nil
+}
+
+// registerVaultSecret makes sure the lease ID, tokens and data of a secret
+// returned by Vault are never logged.
+func registerVaultSecret(secret *vaultapi.Secret) {
+	if secret == nil {
+		return
+	}
+	redactor.add(secret.LeaseID)
+	redactor.addData(secret.Data)
+	if secret.Auth != nil {
+		redactor.add(secret.Auth.ClientToken, secret.Auth.Accessor)
+	}
+	if secret.WrapInfo != nil {
+		redactor.add(secret.WrapInfo.Token, secret.WrapInfo.WrappedAccessor)
+	}
+}
+
+// vaultMethod maps the method declared on a CustomSecret to the HTTP verb
+// used against Vault.
+func vaultMethod(method string) (string, error) {
+	switch strings.ToUpper(method) {
+	case "", "GET", "READ":
+		return "GET", nil
+	case "POST", "PUT", "WRITE":
+		return "PUT", nil
+	}
+	return "", errors.New("unsupported method: " + method)
+}
+
+// requestVaultSecret issues the request described by the CustomSecret spec.
+// Read-style requests (the default) GET the policy path, while write-style
+// requests send the spec parameters as the body. Either way the returned
+// secret is handled the same by the processor. If ttl isn't 0 it's passed as
+// the ttl parameter, unless the spec parameters already set one.
+func (vc *vaultClient) requestVaultSecret(spec CustomSecretSpec, ttl int) (*vaultapi.Secret, error) {
+	method, err := vaultMethod(spec.Method)
+	if err != nil {
+		return nil, err
+	}
+
+	var secret *vaultapi.Secret
+	switch {
+	case method == "PUT" && ttl > 0 && spec.Parameters["ttl"] == nil:
+		params := make(map[string]interface{}, len(spec.Parameters)+1)
+		for k, v := range spec.Parameters {
+			params[k] = v
+		}
+		params["ttl"] = fmt.Sprintf("%ds", ttl)
+		secret, err = vc.writeVaultSecret(spec.Policy, params)
+	case method == "PUT":
+		secret, err = vc.writeVaultSecret(spec.Policy, spec.Parameters)
+	case ttl > 0:
+		secret, err = vc.readVaultSecretTTL(spec.Policy, ttl)
+	default:
+		secret, err = vc.readVaultSecret(spec.Policy)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	if secret == nil {
+		return nil, errors.New("no secret returned for path: " + spec.Policy)
+	}
+	trackLease(vc, secret)
+
+	return secret, nil
+}
+
+// wrapVaultSecret issues the request described by the CustomSecret spec but
+// asks Vault to wrap the response, so only the wrapping token is returned.
+func (vc *vaultClient) wrapVaultSecret(spec CustomSecretSpec) (*vaultapi.SecretWrapInfo, error) {
+	method, err := vaultMethod(spec.Method)
+	if err != nil {
+		return nil, err
+	}
+
+	r := vc.client.NewRequest(method, "/v1/"+spec.Policy)
+	r.WrapTTL = spec.WrapTTL
+	if method == "PUT" {
+		if err := r.SetJSONBody(spec.Parameters); err != nil {
+			return nil, err
+		}
+	}
+
+	resp, err := vc.client.RawRequest(r)
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	if err != nil {
+		logError("Error getting wrapped secret from Vault", logFields{"vault_path": spec.Policy, "error": err})
+		return nil, err
+	}
+
+	secret, err := vaultapi.ParseSecret(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if secret == nil || secret.WrapInfo == nil {
+		return nil, errors.New("response was not wrapped for path: " + spec.Policy)
+	}
+	redactor.add(secret.WrapInfo.Token, secret.WrapInfo.WrappedAccessor)
+
+	return secret.WrapInfo, nil
+}
+
+// unwrapVaultSecret exchanges a wrapping token for the secret it wraps. The
+// request authenticates with the wrapping token rather than the client's.
+func (vc *vaultClient) unwrapVaultSecret(token string) (*vaultapi.Secret, error) {
+	redactor.add(token)
+	r := vc.client.NewRequest("PUT", "/v1/sys/wrapping/unwrap")
+	r.ClientToken = token
+
+	resp, err := vc.client.RawRequest(r)
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	secret, err := vaultapi.ParseSecret(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if secret == nil {
+		return nil, errors.New("unwrapping returned no secret")
+	}
+	registerVaultSecret(secret)
+	return secret, nil
+}
+
+// vaultLease is what Vault reports about a lease
+type vaultLease struct {
+	IssueTime  time.Time
+	ExpireTime time.Time
+}
+
+// lookupVaultLease asks Vault when a lease was issued and when it expires
+func (vc *vaultClient) lookupVaultLease(leaseID string) (*vaultLease, error) {
+	redactor.add(leaseID)
+	r := vc.client.NewRequest("PUT", "/v1/sys/leases/lookup")
+	if err := r.SetJSONBody(map[string]interface{}{"lease_id": leaseID}); err != nil {
+		return nil, err
+	}
+
+	resp, err := vc.client.RawRequest(r)
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	secret, err := vaultapi.ParseSecret(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if secret == nil || secret.Data == nil {
+		return nil, errors.New("no lease returned by lookup")
+	}
+
+	var lease vaultLease
+	expireTime, _ := secret.Data["expire_time"].(string)
+	lease.ExpireTime, err = time.Parse(time.RFC3339Nano, expireTime)
+	if err != nil {
+		return nil, fmt.Errorf("invalid expire_time %q: %v", expireTime, err)
+	}
+	if issueTime, ok := secret.Data["issue_time"].(string); ok {
+		lease.IssueTime, _ = time.Parse(time.RFC3339Nano, issueTime)
+	}
+	return &lease, nil
 }
 
+// revokeVaultSecret revokes a lease. The lease ID is part of the request
+// URL, so it's registered with the redactor in case it was loaded from the
+// local database and never seen in a Vault response.
 func (vc *vaultClient) revokeVaultSecret(leaseID string) error {
+	redactor.add(leaseID)
 	err := vc.client.Sys().Revoke(leaseID)
 
 	if err != nil {
-		log.Println("[Vault] Error revoking secret: ", err)
+		logError("Error revoking secret in Vault", logFields{}.withLease(leaseID).with("error", err))
 		return err
 	}
+	forgetLease(leaseID)
 
 	return nil
 }
 
 func (vc *vaultClient) renewVaultLease(leaseID string, leaseDuration int) (*vaultapi.Secret, error) {
+	redactor.add(leaseID)
 	secret, err := vc.client.Sys().Renew(leaseID, leaseDuration)
 
 	if err != nil {
-		log.Println("[Vault] Error renewing secret: ", err)
+		logError("Error renewing secret in Vault", logFields{}.withLease(leaseID).with("error", err))
 		return nil, err
 	}
+	registerVaultSecret(secret)
+	extendTrackedLease(leaseID, secret.LeaseDuration)
 
 	return secret, nil
 }
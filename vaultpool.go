@@ -0,0 +1,398 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"time"
+
+	vaultapi "github.com/hashicorp/vault/api"
+)
+
+// defaultVaultConnection is the name the default client is reported under.
+// It can't clash with a VaultConnection as it isn't a valid resource name.
+const defaultVaultConnection = "(default)"
+
+// vaultClientPool holds an authenticated client per VaultConnection. Secrets
+// which don't reference a VaultConnection use the default client configured
+// from the command line flags.
+type vaultClientPool struct {
+	sync.Mutex
+	defaultClient *vaultClient
+	clients       map[string]*pooledVaultClient
+
+	// retired are replaced clients whose token still has to be revoked
+	retired []*pooledVaultClient
+
+	// connect creates the client of a VaultConnection. A dry run replaces
+	// it so that nothing is sent to Vault.
+	connect func(name string, spec VaultConnectionSpec) (*pooledVaultClient, error)
+}
+
+type pooledVaultClient struct {
+	spec            VaultConnectionSpec
+	client          *vaultClient
+	tokenExpiration time.Time
+	// tokenExpiry is when the token expires by itself
+	tokenExpiry time.Time
+	renewable   bool
+}
+
+// leaseOwners records the client each lease was issued with. Vault revokes
+// the leases a token created along with the token, so a replaced token is
+// only revoked once none of its leases are still in use.
+var leaseOwners = struct {
+	sync.Mutex
+	leases map[string]leaseOwner
+}{leases: make(map[string]leaseOwner)}
+
+type leaseOwner struct {
+	client  *vaultClient
+	expires time.Time
+}
+
+// trackLease records that the lease of secret was issued with vc
+func trackLease(vc *vaultClient, secret *vaultapi.Secret) {
+	if secret.LeaseID == "" {
+		return
+	}
+	leaseOwners.Lock()
+	defer leaseOwners.Unlock()
+	leaseOwners.leases[secret.LeaseID] = leaseOwner{
+		client:  vc,
+		expires: time.Now().Add(time.Second * time.Duration(secret.LeaseDuration)),
+	}
+}
+
+// extendTrackedLease records the new expiry of a renewed lease
+func extendTrackedLease(leaseID string, leaseDuration int) {
+	leaseOwners.Lock()
+	defer leaseOwners.Unlock()
+	if owner, ok := leaseOwners.leases[leaseID]; ok {
+		owner.expires = time.Now().Add(time.Second * time.Duration(leaseDuration))
+		leaseOwners.leases[leaseID] = owner
+	}
+}
+
+// forgetLease stops tracking a revoked lease
+func forgetLease(leaseID string) {
+	leaseOwners.Lock()
+	defer leaseOwners.Unlock()
+	delete(leaseOwners.leases, leaseID)
+}
+
+// leasesInUse returns true if a lease issued with vc hasn't expired yet
+func leasesInUse(vc *vaultClient) bool {
+	leaseOwners.Lock()
+	defer leaseOwners.Unlock()
+	inUse := false
+	for leaseID, owner := range leaseOwners.leases {
+		if time.Now().After(owner.expires) {
+			delete(leaseOwners.leases, leaseID)
+		} else if owner.client == vc {
+			inUse = true
+		}
+	}
+	return inUse
+}
+
+func newVaultClientPool(defaultClient *vaultClient) *vaultClientPool {
+	return &vaultClientPool{
+		defaultClient: defaultClient,
+		clients:       make(map[string]*pooledVaultClient),
+		connect: func(_ string, spec VaultConnectionSpec) (*pooledVaultClient, error) {
+			return newPooledVaultClient(spec)
+		},
+	}
+}
+
+// get returns the client for the named VaultConnection, creating and
+// authenticating it if needed. An empty name returns the default client.
+func (p *vaultClientPool) get(name string) (*vaultClient, error) {
+	if name == "" {
+		if p.defaultClient == nil {
+			return nil, errors.New("no default Vault client configured")
+		}
+		return p.defaultClient, nil
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	p.revokeRetired()
+
+	pc, existing := p.clients[name]
+	if existing {
+		if pc.tokenExpiration.IsZero() || time.Now().Before(pc.tokenExpiration) {
+			return pc.client, nil
+		}
+		// Renewing keeps the leases issued with the token valid, so only log
+		// in again once the token can't be renewed anymore
+		err := pc.renew()
+		if err == nil {
+			logDebug("Renewed Vault token", logFields{"vault_connection": name})
+			return pc.client, nil
+		}
+		logInfo("Vault token can't be renewed, logging in again", logFields{"vault_connection": name, "reason": err})
+	}
+
+	spec, err := vaultConnectionSpec(name)
+	if err != nil {
+		return nil, err
+	}
+
+	replacement, err := p.connect(name, spec)
+	if err != nil {
+		return nil, errors.New("[Vault] Error connecting to " + name + ": " + err.Error())
+	}
+	p.clients[name] = replacement
+	if existing && pc != nil {
+		p.retire(name, pc)
+	}
+
+	return replacement.client, nil
+}
+
+// retire queues the token of a replaced client for revocation. Tokens taken
+// from a secret with the token auth method aren't the controller's to
+// revoke. Must be called with the pool locked.
+// vaultConnectionSpec returns the settings of the named VaultConnection.
+// Connections from the config file take precedence over resources.
+func vaultConnectionSpec(name string) (VaultConnectionSpec, error) {
+	spec, ok := getFileVaultConnection(name)
+	if ok {
+		return spec, nil
+	}
+	vaultConnection, err := getVaultConnection(name)
+	if err != nil {
+		return VaultConnectionSpec{}, err
+	}
+	return vaultConnection.Spec, nil
+}
+
+func (p *vaultClientPool) retire(name string, pc *pooledVaultClient) {
+	if pc.spec.Auth.Method == "" || pc.spec.Auth.Method == "token" {
+		return
+	}
+	logDebug("Retiring Vault client", logFields{"vault_connection": name})
+	p.retired = append(p.retired, pc)
+}
+
+// revokeRetired revokes the tokens of retired clients that no lease depends
+// on anymore, and forgets those that have expired. Must be called with the
+// pool locked.
+func (p *vaultClientPool) revokeRetired() {
+	var retired []*pooledVaultClient
+	for _, pc := range p.retired {
+		if !pc.tokenExpiry.IsZero() && time.Now().After(pc.tokenExpiry) {
+			continue
+		}
+		if leasesInUse(pc.client) {
+			retired = append(retired, pc)
+			continue
+		}
+		go func(vc *vaultClient) {
+			err := vc.revokeSelf()
+			if err != nil {
+				logWarn("Error revoking replaced Vault token", logFields{"error": err})
+			}
+		}(pc.client)
+	}
+	p.retired = retired
+}
+
+// breakerStatus returns the circuit breaker state of every client in the
+// pool, keyed by VaultConnection name.
+func (p *vaultClientPool) breakerStatus() map[string]circuitBreakerStatus {
+	status := make(map[string]circuitBreakerStatus)
+	for name, vc := range p.all() {
+		status[name] = vc.breaker.status()
+	}
+	return status
+}
+
+// all returns every client in the pool, keyed by VaultConnection name.
+func (p *vaultClientPool) all() map[string]*vaultClient {
+	p.Lock()
+	defer p.Unlock()
+
+	clients := make(map[string]*vaultClient)
+	if p.defaultClient != nil {
+		clients[defaultVaultConnection] = p.defaultClient
+	}
+	for name, pc := range p.clients {
+		clients[name] = pc.client
+	}
+	return clients
+}
+
+// refresh drops clients whose VaultConnection was deleted or changed, so
+// they are recreated with the new settings on next use.
+func (p *vaultClientPool) refresh(vaultConnections []VaultConnection) {
+	specs := make(map[string]VaultConnectionSpec)
+	for _, vc := range vaultConnections {
+		specs[vc.Metadata["name"]] = vc.Spec
+	}
+
+	p.Lock()
+	defer p.Unlock()
+
+	for name, pc := range p.clients {
+		spec, ok := specs[name]
+		if !ok || !reflect.DeepEqual(spec, pc.spec) {
+			logInfo("Vault connection changed, dropping client", logFields{"vault_connection": name})
+			delete(p.clients, name)
+			p.retire(name, pc)
+		}
+	}
+	p.revokeRetired()
+}
+
+func newPooledVaultClient(spec VaultConnectionSpec) (*pooledVaultClient, error) {
+	client, err := newVaultConnectionClient(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	credentials := make(map[string]string)
+	if spec.Auth.SecretName != "" {
+		credentials, err = getKubernetesSecret(spec.Auth.SecretName)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	auth, err := client.login(spec.Auth, credentials)
+	if err != nil {
+		return nil, err
+	}
+
+	pc := &pooledVaultClient{
+		spec:   spec,
+		client: client,
+	}
+	pc.setTokenLease(auth)
+
+	return pc, nil
+}
+
+// setTokenLease records when the token has to be renewed: once half of its
+// TTL has passed. Tokens without a TTL (e.g. root tokens) never expire.
+func (pc *pooledVaultClient) setTokenLease(auth *vaultapi.SecretAuth) {
+	pc.renewable = auth.Renewable
+	pc.tokenExpiration = time.Time{}
+	pc.tokenExpiry = time.Time{}
+	if auth.LeaseDuration > 0 {
+		pc.tokenExpiration = time.Now().Add(time.Second * time.Duration(auth.LeaseDuration/2))
+		pc.tokenExpiry = time.Now().Add(time.Second * time.Duration(auth.LeaseDuration))
+	}
+}
+
+// renew extends the client's token. It fails once Vault doesn't extend the
+// token anymore, because it has reached its max TTL.
+func (pc *pooledVaultClient) renew() error {
+	if !pc.renewable {
+		return errors.New("token is not renewable")
+	}
+	auth, err := pc.client.renewSelf()
+	if err != nil {
+		return err
+	}
+	expiry := time.Now().Add(time.Second * time.Duration(auth.LeaseDuration))
+	if expiry.Before(pc.tokenExpiry.Add(leaseCapTolerance)) {
+		return errors.New("token has reached its max TTL")
+	}
+	pc.setTokenLease(auth)
+	return nil
+}
+
+// adoptLeases restores the owners of the leases stored locally after a
+// restart. The tokens that issued them aren't used by the pool anymore, so
+// they're retired and revoked once their leases have been revoked or have
+// expired.
+func (p *vaultClientPool) adoptLeases(secrets map[string]CustomSecretSpec) {
+	p.Lock()
+	defer p.Unlock()
+
+	owners := make(map[string]*pooledVaultClient)
+	adopt := func(connection, token, leaseID string, expires time.Time) {
+		if connection == "" || token == "" || leaseID == "" || time.Now().After(expires) {
+			return
+		}
+		pc, ok := owners[token]
+		if !ok {
+			var err error
+			pc, err = adoptedVaultClient(connection, token)
+			if err != nil {
+				logWarn("Error adopting stored Vault token", logFields{"vault_connection": connection, "error": err})
+			}
+			owners[token] = pc
+			if pc != nil {
+				p.retire(connection, pc)
+			}
+		}
+		if pc == nil {
+			return
+		}
+		leaseOwners.Lock()
+		defer leaseOwners.Unlock()
+		leaseOwners.leases[leaseID] = leaseOwner{client: pc.client, expires: expires}
+	}
+
+	for _, secret := range secrets {
+		adopt(secret.VaultConnection, secret.LeaseToken, secret.LeaseID, secret.LeaseExpirationDate)
+		adopt(secret.PreviousVaultConnection, secret.PreviousLeaseToken, secret.PreviousLeaseID, secret.PreviousRevokeDate)
+	}
+}
+
+// adoptedVaultClient returns a client using a token stored with a lease, or
+// nil if the token is never revoked or isn't valid anymore
+func adoptedVaultClient(connection, token string) (*pooledVaultClient, error) {
+	spec, err := vaultConnectionSpec(connection)
+	if err != nil {
+		return nil, err
+	}
+	if spec.Auth.Method == "" || spec.Auth.Method == "token" {
+		return nil, nil
+	}
+
+	client, err := newVaultConnectionClient(spec)
+	if err != nil {
+		return nil, err
+	}
+	client.client.SetToken(token)
+	ttl, err := client.tokenTTL()
+	if err != nil {
+		logDebug("Stored Vault token isn't valid anymore", logFields{"vault_connection": connection, "error": err})
+		return nil, nil
+	}
+
+	pc := &pooledVaultClient{spec: spec, client: client}
+	if ttl > 0 {
+		pc.tokenExpiry = time.Now().Add(ttl)
+	}
+	return pc, nil
+}
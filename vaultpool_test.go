@@ -0,0 +1,323 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeVault issues a new token for every login, renews tokens unless
+// renewals are refused, issues database/creds/app credentials and records the
+// requests with the token they used
+type fakeVault struct {
+	sync.Mutex
+	*httptest.Server
+	logins         int
+	refuseRenewals bool
+	requests       []string
+	jwt            string
+}
+
+func newFakeVault(t *testing.T) *fakeVault {
+	fv := &fakeVault{}
+	fv.Server = httptest.NewServer(http.HandlerFunc(fv.serve))
+	t.Cleanup(fv.Close)
+	return fv
+}
+
+func (fv *fakeVault) serve(w http.ResponseWriter, r *http.Request) {
+	fv.Lock()
+	defer fv.Unlock()
+	token := r.Header.Get("X-Vault-Token")
+	fv.requests = append(fv.requests, r.Method+" "+r.URL.Path+" "+token)
+
+	w.Header().Set("Content-Type", "application/json")
+	switch r.URL.Path {
+	case "/v1/auth/approle/login", "/v1/auth/kubernetes/login":
+		var body struct {
+			JWT string `json:"jwt"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		if body.JWT != "" {
+			fv.jwt = body.JWT
+		}
+		fv.logins++
+		fmt.Fprintf(w, `{"auth":{"client_token":"s.token%d","lease_duration":60,"renewable":true}}`, fv.logins)
+	case "/v1/auth/token/renew-self":
+		if fv.refuseRenewals {
+			badRequest(w, r)
+			return
+		}
+		fmt.Fprintf(w, `{"auth":{"client_token":%q,"lease_duration":60,"renewable":true}}`, token)
+	case "/v1/auth/token/lookup-self":
+		fmt.Fprint(w, `{"data":{"ttl":3600,"renewable":true}}`)
+	case "/v1/auth/token/revoke-self":
+		w.WriteHeader(http.StatusNoContent)
+	case "/v1/database/creds/app":
+		fmt.Fprint(w, `{"lease_id":"database/creds/app/1","lease_duration":3600,"renewable":true,"data":{"username":"app","password":"hunter2hunter2hunter2"}}`)
+	default:
+		badRequest(w, r)
+	}
+}
+
+func (fv *fakeVault) loginCount() int {
+	fv.Lock()
+	defer fv.Unlock()
+	return fv.logins
+}
+
+func (fv *fakeVault) refuseRenewal() {
+	fv.Lock()
+	defer fv.Unlock()
+	fv.refuseRenewals = true
+}
+
+// received returns true if a request was made for path with token
+func (fv *fakeVault) received(method, path, token string) bool {
+	fv.Lock()
+	defer fv.Unlock()
+	for _, r := range fv.requests {
+		if r == method+" "+path+" "+token {
+			return true
+		}
+	}
+	return false
+}
+
+// useFileVaultConnection registers a connection as if read from the config file
+func useFileVaultConnection(t *testing.T, name string, spec VaultConnectionSpec) {
+	settingsLock.Lock()
+	previous, ok := fileVaultConnections[name]
+	fileVaultConnections[name] = spec
+	settingsLock.Unlock()
+	t.Cleanup(func() {
+		settingsLock.Lock()
+		defer settingsLock.Unlock()
+		if ok {
+			fileVaultConnections[name] = previous
+		} else {
+			delete(fileVaultConnections, name)
+		}
+	})
+}
+
+// useKubernetesAPI points the controller at a fake Kubernetes API
+func useKubernetesAPI(t *testing.T, handler http.HandlerFunc) {
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	previous := apiHost
+	apiHost = srv.URL
+	t.Cleanup(func() { apiHost = previous })
+}
+
+// expire makes the pool treat the named client's token as halfway through
+// its TTL, so it's due for renewal
+func (p *vaultClientPool) expire(name string) {
+	p.Lock()
+	defer p.Unlock()
+	p.clients[name].tokenExpiration = time.Now().Add(-time.Second)
+	p.clients[name].tokenExpiry = time.Now().Add(30 * time.Second)
+}
+
+func assertPoolLifecycle(t *testing.T, fv *fakeVault, name string) {
+	t.Helper()
+	pool := newVaultClientPool(nil)
+
+	first, err := pool.get(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fv.loginCount() != 1 || len(pool.retired) != 0 {
+		t.Fatalf("first use: %d logins, %d retired", fv.loginCount(), len(pool.retired))
+	}
+
+	again, err := pool.get(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != first || fv.loginCount() != 1 {
+		t.Fatalf("valid token was not reused: %d logins", fv.loginCount())
+	}
+
+	pool.expire(name)
+	renewed, err := pool.get(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if renewed != first || fv.loginCount() != 1 || len(pool.retired) != 0 {
+		t.Fatalf("token was not renewed: %d logins, %d retired", fv.loginCount(), len(pool.retired))
+	}
+	if !fv.received("PUT", "/v1/auth/token/renew-self", "s.token1") {
+		t.Fatal("token was not renewed with renew-self")
+	}
+
+	fv.refuseRenewal()
+	pool.expire(name)
+	replacement, err := pool.get(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replacement == first || fv.loginCount() != 2 {
+		t.Fatalf("token that can't be renewed was not replaced: %d logins", fv.loginCount())
+	}
+	if len(pool.retired) != 1 || pool.retired[0].client != first {
+		t.Fatalf("expired client was not retired: %v", pool.retired)
+	}
+}
+
+func TestVaultClientPoolFileConnection(t *testing.T) {
+	captureLogs(t)
+	fv := newFakeVault(t)
+	useFileVaultConnection(t, "from-file", VaultConnectionSpec{
+		Address: fv.URL,
+		Auth:    VaultAuthSpec{Method: "approle"},
+	})
+	useKubernetesAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("file connection looked up %s", r.URL.Path)
+		http.NotFound(w, r)
+	})
+
+	assertPoolLifecycle(t, fv, "from-file")
+}
+
+func TestVaultClientPoolResourceConnection(t *testing.T) {
+	captureLogs(t)
+	fv := newFakeVault(t)
+	useKubernetesAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != vaultConnectionsEndpoint+"/from-resource" {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(VaultConnection{
+			Metadata: map[string]string{"name": "from-resource"},
+			Spec: VaultConnectionSpec{
+				Address: fv.URL,
+				Auth:    VaultAuthSpec{Method: "approle"},
+			},
+		})
+	})
+
+	assertPoolLifecycle(t, fv, "from-resource")
+}
+
+func TestVaultClientPoolRenewalCapped(t *testing.T) {
+	captureLogs(t)
+	fv := newFakeVault(t)
+	useFileVaultConnection(t, "capped", VaultConnectionSpec{
+		Address: fv.URL,
+		Auth:    VaultAuthSpec{Method: "approle"},
+	})
+	pool := newVaultClientPool(nil)
+	if _, err := pool.get("capped"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Vault renews a token that reached its max TTL without extending it
+	pool.Lock()
+	pool.clients["capped"].tokenExpiration = time.Now().Add(-time.Second)
+	pool.clients["capped"].tokenExpiry = time.Now().Add(60 * time.Second)
+	pool.Unlock()
+	if _, err := pool.get("capped"); err != nil {
+		t.Fatal(err)
+	}
+	if fv.loginCount() != 2 || len(pool.retired) != 1 {
+		t.Fatalf("capped token was not replaced: %d logins, %d retired", fv.loginCount(), len(pool.retired))
+	}
+}
+
+func TestVaultClientPoolAdoptLeases(t *testing.T) {
+	captureLogs(t)
+	fv := newFakeVault(t)
+	useFileVaultConnection(t, "from-file", VaultConnectionSpec{
+		Address: fv.URL,
+		Auth:    VaultAuthSpec{Method: "approle"},
+	})
+	useFileVaultConnection(t, "static", VaultConnectionSpec{
+		Address: fv.URL,
+		Auth:    VaultAuthSpec{Method: "token"},
+	})
+
+	db := openTestDB(t)
+	expires := time.Now().Add(time.Hour)
+	stored := map[string]CustomSecretSpec{
+		"db":    {Secret: "db", VaultConnection: "from-file", LeaseID: "database/creds/db/1", LeaseToken: "s.old", LeaseExpirationDate: expires},
+		"cache": {Secret: "cache", VaultConnection: "from-file", LeaseID: "database/creds/cache/1", LeaseToken: "s.old", LeaseExpirationDate: expires},
+		"queue": {Secret: "queue", VaultConnection: "static", LeaseID: "database/creds/queue/1", LeaseToken: "s.static", LeaseExpirationDate: expires},
+	}
+	for name, spec := range stored {
+		if err := persistSecretLocal(name, spec, db); err != nil {
+			t.Fatal(err)
+		}
+	}
+	secrets, err := listSecretsLocal(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secrets["db"].LeaseToken != "s.old" {
+		t.Fatalf("lease token was not stored: %+v", secrets["db"])
+	}
+
+	pool := newVaultClientPool(nil)
+	pool.adoptLeases(secrets)
+	t.Cleanup(func() {
+		for _, spec := range stored {
+			forgetLease(spec.LeaseID)
+		}
+	})
+
+	if len(pool.retired) != 1 || pool.retired[0].client.client.Token() != "s.old" {
+		t.Fatalf("stored token was not retired once: %v", pool.retired)
+	}
+	owner := pool.retired[0].client
+
+	forgetLease("database/creds/db/1")
+	pool.Lock()
+	pool.revokeRetired()
+	pool.Unlock()
+	if len(pool.retired) != 1 {
+		t.Fatal("token was revoked while a lease it issued is in use")
+	}
+
+	forgetLease("database/creds/cache/1")
+	pool.Lock()
+	pool.revokeRetired()
+	pool.Unlock()
+	if len(pool.retired) != 0 || leasesInUse(owner) {
+		t.Fatal("token was not revoked once its leases were gone")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !fv.received("PUT", "/v1/auth/token/revoke-self", "s.old") {
+		if time.Now().After(deadline) {
+			t.Fatal("stored token was not revoked")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,196 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sethgrid/pester"
+)
+
+var (
+	vaultMaxRetries       = 3
+	vaultMaxBackoff       = 30 * time.Second
+	vaultBreakerThreshold = 5
+	vaultBreakerCooldown  = 30 * time.Second
+
+	errCircuitOpen = errors.New("circuit breaker is open, Vault is unavailable")
+)
+
+// retryTransport retries Vault requests which failed for a transient reason
+// (connection errors and 5xx responses, e.g. while sealed or during a
+// standby failover) with jittered exponential backoff. Client errors such as
+// permission denied are returned straight away. Every request goes through
+// the circuit breaker, which fails requests fast while Vault is down.
+type retryTransport struct {
+	transport http.RoundTripper
+	breaker   *circuitBreaker
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !t.breaker.allow() {
+		return nil, errCircuitOpen
+	}
+
+	var resp *http.Response
+	var err error
+	for attempt := 0; ; attempt++ {
+		r := req
+		if attempt > 0 && req.Body != nil {
+			// The body was consumed by the previous attempt
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			r = new(http.Request)
+			*r = *req
+			r.Body = body
+		}
+
+		resp, err = t.transport.RoundTrip(r)
+		if !retryableVaultResponse(resp, err) || attempt >= vaultMaxRetries {
+			break
+		}
+		if req.Body != nil && req.GetBody == nil {
+			break
+		}
+
+		if resp != nil {
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		time.Sleep(vaultBackoff(attempt))
+	}
+
+	t.breaker.record(!retryableVaultResponse(resp, err))
+
+	return resp, err
+}
+
+func retryableVaultResponse(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests:
+		return true
+	case resp.StatusCode == http.StatusNotImplemented:
+		return false
+	case resp.StatusCode >= 500:
+		return true
+	}
+	return false
+}
+
+func vaultBackoff(attempt int) time.Duration {
+	backoff := pester.ExponentialJitterBackoff(attempt)
+	if backoff > vaultMaxBackoff {
+		return vaultMaxBackoff
+	}
+	return backoff
+}
+
+// circuitBreaker opens after a number of consecutive failed requests, and
+// rejects all requests until the cooldown has passed. A single probe request
+// is then let through; if it succeeds the breaker closes again.
+type circuitBreaker struct {
+	sync.Mutex
+	state     string
+	failures  int
+	openedAt  time.Time
+	lastError time.Time
+}
+
+// circuitBreakerStatus is the state of a breaker reported by the health
+// endpoint
+type circuitBreakerStatus struct {
+	State     string    `json:"state"`
+	Failures  int       `json:"failures"`
+	OpenedAt  time.Time `json:"openedAt"`
+	LastError time.Time `json:"lastError"`
+}
+
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half-open"
+)
+
+func newCircuitBreaker() *circuitBreaker {
+	return &circuitBreaker{state: breakerClosed}
+}
+
+func (b *circuitBreaker) allow() bool {
+	b.Lock()
+	defer b.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) >= vaultBreakerCooldown {
+			b.state = breakerHalfOpen
+			return true
+		}
+		return false
+	case breakerHalfOpen:
+		// Only the probe request is let through
+		return false
+	}
+	return true
+}
+
+func (b *circuitBreaker) record(success bool) {
+	b.Lock()
+	defer b.Unlock()
+
+	if success {
+		b.failures = 0
+		b.state = breakerClosed
+		return
+	}
+
+	b.failures++
+	b.lastError = time.Now()
+	if b.state == breakerHalfOpen || b.failures >= vaultBreakerThreshold {
+		b.state = breakerOpen
+		b.openedAt = time.Now()
+	}
+}
+
+func (b *circuitBreaker) status() circuitBreakerStatus {
+	b.Lock()
+	defer b.Unlock()
+
+	return circuitBreakerStatus{
+		State:     b.state,
+		Failures:  b.failures,
+		OpenedAt:  b.openedAt,
+		LastError: b.lastError,
+	}
+}
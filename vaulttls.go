@@ -0,0 +1,188 @@
+/*
+Copyright (c) 2016, UPMC Enterprises
+All rights reserved.
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+    * Redistributions of source code must retain the above copyright
+      notice, this list of conditions and the following disclaimer.
+    * Redistributions in binary form must reproduce the above copyright
+      notice, this list of conditions and the following disclaimer in the
+      documentation and/or other materials provided with the distribution.
+    * Neither the name UPMC Enterprises nor the
+      names of its contributors may be used to endorse or promote products
+      derived from this software without specific prior written permission.
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL UPMC ENTERPRISES BE LIABLE FOR ANY
+DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+(INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+*/
+
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-cleanhttp"
+	"github.com/hashicorp/go-rootcerts"
+)
+
+// tlsReloadInterval is how often the certificate files are checked for
+// changes.
+var tlsReloadInterval = 30 * time.Second
+
+// tlsReloadingTransport is an http.RoundTripper which builds its TLS
+// settings from files on disk, and swaps in a new transport when any of
+// those files change. If the new files can't be loaded the previous
+// transport keeps being used.
+type tlsReloadingTransport struct {
+	sync.Mutex
+	spec      VaultTLSSpec
+	transport *http.Transport
+	files     map[string]string
+	lastCheck time.Time
+}
+
+func newTLSReloadingTransport(spec VaultTLSSpec) (*tlsReloadingTransport, error) {
+	t := &tlsReloadingTransport{spec: spec}
+	err := t.reload()
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *tlsReloadingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.Lock()
+	if time.Since(t.lastCheck) >= tlsReloadInterval {
+		t.lastCheck = time.Now()
+		if t.changed() {
+			logInfo("Vault TLS files changed, reloading", nil)
+			err := t.reload()
+			if err != nil {
+				logError("Error reloading Vault TLS files, keeping previous settings", logFields{"error": err})
+			}
+		}
+	}
+	transport := t.transport
+	t.Unlock()
+
+	return transport.RoundTrip(req)
+}
+
+// reload builds a new transport from the TLS files. The caller must hold
+// the lock.
+func (t *tlsReloadingTransport) reload() error {
+	// Record the state of the files before reading, so a change made while
+	// loading is picked up by the next check.
+	files := t.currentFiles()
+
+	tlsConfig, err := newVaultTLSConfig(t.spec)
+	if err != nil {
+		return err
+	}
+
+	transport := cleanhttp.DefaultPooledTransport()
+	transport.TLSHandshakeTimeout = 10 * time.Second
+	transport.TLSClientConfig = tlsConfig
+
+	if t.transport != nil {
+		t.transport.CloseIdleConnections()
+	}
+	t.transport = transport
+	t.files = files
+	t.lastCheck = time.Now()
+
+	return nil
+}
+
+// changed returns true if a file was added, removed or modified since the
+// last reload
+func (t *tlsReloadingTransport) changed() bool {
+	current := t.currentFiles()
+	if len(current) != len(t.files) {
+		return true
+	}
+	for path, state := range current {
+		previous, ok := t.files[path]
+		if !ok || state != previous {
+			return true
+		}
+	}
+	return false
+}
+
+// currentFiles describes each configured file, and each file in CAPath, by
+// its modification time and size, or the error stating it. Stat follows
+// symlinks, so the atomic symlink swap used by Kubernetes secret volumes is
+// detected too. A directory's modification time doesn't change when a file
+// in it is edited in place, which is why CAPath's entries are listed.
+func (t *tlsReloadingTransport) currentFiles() map[string]string {
+	files := make(map[string]string)
+	stat := func(path string) {
+		fi, err := os.Stat(path)
+		if err != nil {
+			files[path] = err.Error()
+			return
+		}
+		files[path] = fmt.Sprintf("%s %d", fi.ModTime().Format(time.RFC3339Nano), fi.Size())
+	}
+
+	for _, path := range []string{t.spec.CACert, t.spec.ClientCert, t.spec.ClientKey} {
+		if path != "" {
+			stat(path)
+		}
+	}
+	if t.spec.CAPath != "" {
+		stat(t.spec.CAPath)
+		entries, err := ioutil.ReadDir(t.spec.CAPath)
+		if err == nil {
+			for _, entry := range entries {
+				if !entry.IsDir() {
+					stat(filepath.Join(t.spec.CAPath, entry.Name()))
+				}
+			}
+		}
+	}
+	return files
+}
+
+func newVaultTLSConfig(spec VaultTLSSpec) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         spec.ServerName,
+		InsecureSkipVerify: spec.Insecure,
+	}
+
+	err := rootcerts.ConfigureTLS(tlsConfig, &rootcerts.Config{
+		CAFile: spec.CACert,
+		CAPath: spec.CAPath,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if spec.ClientCert != "" && spec.ClientKey != "" {
+		clientCert, err := tls.LoadX509KeyPair(spec.ClientCert, spec.ClientKey)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{clientCert}
+	} else if spec.ClientCert != "" || spec.ClientKey != "" {
+		return nil, errors.New("both client cert and client key must be provided")
+	}
+
+	return tlsConfig, nil
+}